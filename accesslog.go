@@ -0,0 +1,98 @@
+package vufs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// A completed request, as given to VuFs.AccessLog.
+type Access struct {
+	Time     time.Time     `json:"time"`     // when the request arrived
+	Addr     string        `json:"addr"`     // the client's, if it has one
+	User     string        `json:"user"`     // empty before an attach
+	Op       string        `json:"op"`       // "walk", "read", ...
+	Fid      uint32        `json:"fid"`      // p.NOFID if there is none
+	Path     string        `json:"path"`     // the fid's file, from the root
+	Err      string        `json:"err"`      // empty if it succeeded
+	Bytes    int           `json:"bytes"`    // data read or written
+	Duration time.Duration `json:"duration"` // until the reply
+}
+
+// The name of each kind of request in an Access.
+var opNames = map[uint8]string{
+	p.Tversion: "version",
+	p.Tauth:    "auth",
+	p.Tattach:  "attach",
+	p.Tflush:   "flush",
+	p.Twalk:    "walk",
+	p.Topen:    "open",
+	p.Tcreate:  "create",
+	p.Tread:    "read",
+	p.Twrite:   "write",
+	p.Tclunk:   "clunk",
+	p.Tremove:  "remove",
+	p.Tstat:    "stat",
+	p.Twstat:   "wstat",
+}
+
+// Note when req arrived, if requests are logged.
+func (u *VuFs) beginAccess(req *srv.Req) {
+	if u.AccessLog == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.reqStart == nil {
+		u.reqStart = make(map[*srv.Req]time.Time)
+	}
+	u.reqStart[req] = time.Now()
+}
+
+// Give AccessLog the request req, being answered.  A created file is
+// logged by its new path.
+func (u *VuFs) logAccess(req *srv.Req) {
+	if u.AccessLog == nil {
+		return
+	}
+	u.mu.Lock()
+	start, ok := u.reqStart[req]
+	delete(u.reqStart, req)
+	u.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	tc, rc := req.Tc, req.Rc
+	a := &Access{
+		Time:     start,
+		Addr:     remoteAddr(req.Conn),
+		Op:       opNames[tc.Type],
+		Fid:      tc.Fid,
+		Duration: time.Since(start),
+	}
+	if tc.Type == p.Tversion {
+		a.Fid = p.NOFID
+	}
+	if req.Fid != nil {
+		if req.Fid.User != nil {
+			a.User = req.Fid.User.Name()
+		}
+		if fid, ok := req.Fid.Aux.(*Fid); ok && fid != nil {
+			a.Path = "/" + strings.TrimLeft(strings.TrimPrefix(fid.path, u.Root), "/")
+		}
+	}
+	if rc != nil {
+		switch rc.Type {
+		case p.Rerror:
+			a.Err = rc.Error
+		case p.Rread:
+			a.Bytes = len(rc.Data)
+		case p.Rwrite:
+			a.Bytes = int(rc.Count)
+		}
+	}
+	u.AccessLog(a)
+}
@@ -0,0 +1,137 @@
+package vufs
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"9fans.net/go/plan9"
+	"github.com/lionkov/go9p/p"
+)
+
+func TestAccessLog(t *testing.T) {
+
+	var mu sync.Mutex
+	var log []Access
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.AccessLog = func(a *Access) {
+			mu.Lock()
+			log = append(log, *a)
+			mu.Unlock()
+		}
+	})
+
+	adm, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := adm.Create("/new.txt", plan9.OWRITE, 0664)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	if _, err = fid.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	fid.Close()
+
+	moe, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	if _, err = moe.Open("/adm/users", plan9.OREAD); err == nil {
+		t.Fatal("moe opened /adm/users\n")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	find := func(op, path string) *Access {
+		for i := range log {
+			if log[i].Op == op && log[i].Path == path {
+				return &log[i]
+			}
+		}
+		t.Errorf("no %s of %s in %+v\n", op, path, log)
+		return nil
+	}
+	if a := find("create", "/new.txt"); a != nil {
+		if a.User != "adm" || a.Err != "" || a.Addr == "" || a.Time.IsZero() {
+			t.Errorf("create logged as %+v\n", a)
+		}
+	}
+	if a := find("write", "/new.txt"); a != nil && a.Bytes != 5 {
+		t.Errorf("write logged %d bytes, expected 5\n", a.Bytes)
+	}
+	if a := find("open", "/adm/users"); a != nil {
+		if a.User != "moe" || a.Err == "" {
+			t.Errorf("denied open logged as %+v\n", a)
+		}
+	}
+}
+
+// A connection with no remote address.
+type noAddrConn struct {
+	net.Conn
+}
+
+func (noAddrConn) RemoteAddr() net.Addr { return nil }
+
+func TestAccessAddr(t *testing.T) {
+
+	var mu sync.Mutex
+	var addrs []string
+	logAddr := func(a *Access) {
+		mu.Lock()
+		addrs = append(addrs, a.Addr)
+		mu.Unlock()
+	}
+	lastAddr := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(addrs) == 0 {
+			return "none"
+		}
+		return addrs[len(addrs)-1]
+	}
+
+	// The address of a TCP client is logged.
+	runserverWith(rootdir, port, func(fs *VuFs) { fs.AccessLog = logAddr })
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+	if addr := lastAddr(); addr != c.LocalAddr().String() {
+		t.Errorf("logged address '%s', expected '%s'\n", addr, c.LocalAddr())
+	}
+
+	// Clients over a pipe, with or without an address, are served.
+	fs := newfs(rootdir)
+	fs.AccessLog = logAddr
+	fs.Start(fs)
+	l := newPipeListener()
+	defer fs.Stop()
+	go fs.StartListener(l)
+
+	for _, tt := range []struct {
+		wrap func(net.Conn) net.Conn
+		addr string
+	}{
+		{func(c net.Conn) net.Conn { return c }, "pipe"},
+		{func(c net.Conn) net.Conn { return noAddrConn{c} }, ""},
+	} {
+		client, server := net.Pipe()
+		defer client.Close()
+		l.conns <- tt.wrap(server)
+
+		rc := &rawConn{client, 8192, false}
+		tx := p.NewFcall(rc.msize)
+		p.PackTversion(tx, rc.msize, "9P2000")
+		rx, err := rc.rpc(tx, p.NOTAG)
+		if err != nil || rx.Type != p.Rversion {
+			t.Fatalf("version: %v %v\n", rx, err)
+		}
+		if addr := lastAddr(); addr != tt.addr {
+			t.Errorf("logged address '%s', expected '%s'\n", addr, tt.addr)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package vufs
+
+import (
+	"crypto/subtle"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Returned when an attach presents an auth fid that did not
+// authenticate the user.
+var Eauth = &p.Error{"authentication failed", p.EPERM}
+
+// An Authenticator decides who can attach.  A client starts with
+// Tauth, which creates an auth fid (afid), then reads and writes the
+// afid to exchange credentials, then presents it in Tattach.
+//
+// Implementations can keep per-afid state in afid.Aux.
+type Authenticator interface {
+	// Auth is called when a client attaches as uname with afid.  It
+	// returns nil if the exchange on afid authenticated the user.
+	Auth(afid *srv.Fid, uname, aname string) error
+
+	// ReadData and WriteData are called for reads and writes on afid.
+	ReadData(afid *srv.Fid, offset uint64, data []byte) (int, error)
+	WriteData(afid *srv.Fid, offset uint64, data []byte) (int, error)
+}
+
+/*
+go9p interface:
+	AuthOps		../../lionkov/go9p/p/srv/srv.go:50,73
+*/
+
+// Start authentication on afid, or report that none is required.
+func (u *VuFs) AuthInit(afid *srv.Fid, aname string) (*p.Qid, error) {
+	if u.Authenticator == nil {
+		return nil, srv.Enoauth
+	}
+	return &p.Qid{Type: p.QTAUTH}, nil
+}
+
+func (u *VuFs) AuthDestroy(afid *srv.Fid) {}
+
+// Check that afid authenticated the user attaching on fid.  With no
+// Authenticator, attaches need no afid.
+func (u *VuFs) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	if u.Authenticator == nil {
+		if afid != nil {
+			return srv.Enoauth
+		}
+		return nil
+	}
+
+	// The afid must be for the same user.
+	if afid == nil || afid.Type&p.QTAUTH == 0 {
+		return Eauth
+	}
+	if fid.User == nil || afid.User == nil || fid.User.Id() != afid.User.Id() {
+		return Eauth
+	}
+
+	return u.Authenticator.Auth(afid, fid.User.Name(), aname)
+}
+
+func (u *VuFs) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	if u.Authenticator == nil {
+		return 0, srv.Enoauth
+	}
+	return u.Authenticator.ReadData(afid, offset, data)
+}
+
+func (u *VuFs) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	if u.Authenticator == nil {
+		return 0, srv.Enoauth
+	}
+	return u.Authenticator.WriteData(afid, offset, data)
+}
+
+// The most bytes a client can write to a SharedSecret afid.
+const maxSecret = 1024
+
+// An Authenticator that lets anyone who knows a secret attach as
+// any user.  The client writes the secret to the afid; there is
+// nothing to read.
+type SharedSecret struct {
+	secret []byte
+	mu     sync.Mutex
+}
+
+func NewSharedSecret(secret string) *SharedSecret {
+	return &SharedSecret{secret: []byte(secret)}
+}
+
+func (s *SharedSecret) Auth(afid *srv.Fid, uname, aname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written, _ := afid.Aux.([]byte)
+	if subtle.ConstantTimeCompare(written, s.secret) != 1 {
+		return Eauth
+	}
+	return nil
+}
+
+func (s *SharedSecret) ReadData(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	return 0, nil
+}
+
+func (s *SharedSecret) WriteData(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset > maxSecret || uint64(len(data)) > maxSecret-offset {
+		return 0, Eauth
+	}
+
+	written, _ := afid.Aux.([]byte)
+	if end := int(offset) + len(data); end > len(written) {
+		written = append(written, make([]byte, end-len(written))...)
+	}
+	copy(written[offset:], data)
+	afid.Aux = written
+
+	return len(data), nil
+}
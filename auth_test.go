@@ -0,0 +1,167 @@
+package vufs
+
+import (
+	"testing"
+
+	"9fans.net/go/plan9"
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// A VuFs that accepts every auth request.
+type openAuthFs struct{ *VuFs }
+
+func (openAuthFs) AuthInit(afid *srv.Fid, aname string) (*p.Qid, error) {
+	return &p.Qid{Type: p.QTAUTH}, nil
+}
+
+func (openAuthFs) AuthDestroy(afid *srv.Fid) {}
+
+func (openAuthFs) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	return nil
+}
+
+func (openAuthFs) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	return 0, nil
+}
+
+func (openAuthFs) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	return len(data), nil
+}
+
+func TestStatAuthFid(t *testing.T) {
+
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.Start(openAuthFs{fs})
+	})
+
+	afid, err := conn.Auth("moe", "/")
+	if err != nil {
+		t.Fatalf("auth: %v\n", err)
+	}
+	defer afid.Close()
+
+	d, err := afid.Stat()
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Qid.Type&plan9.QTAUTH == 0 {
+		t.Errorf("QTAUTH not set in qid type %x\n", d.Qid.Type)
+	}
+	if d.Mode&plan9.DMAUTH == 0 {
+		t.Errorf("DMAUTH not set in mode %o\n", d.Mode)
+	}
+	if d.Uid != "moe" {
+		t.Errorf("uid = '%s', expected 'moe'\n", d.Uid)
+	}
+}
+
+func TestUseAuthFid(t *testing.T) {
+
+	runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.Authenticator = NewSharedSecret("sesame")
+	})
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTauth(tx, 1, "moe", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rauth {
+		t.Fatalf("auth: %v %v\n", rx, err)
+	}
+
+	// An afid is not a file, so can't be walked, opened or created
+	// in, and doing so doesn't bring the server down.
+	for _, tt := range []struct {
+		name string
+		pack func(*p.Fcall) error
+	}{
+		{"walk", func(tx *p.Fcall) error { return p.PackTwalk(tx, 1, 2, nil) }},
+		{"open", func(tx *p.Fcall) error { return p.PackTopen(tx, 1, p.OREAD) }},
+		{"create", func(tx *p.Fcall) error { return p.PackTcreate(tx, 1, "x", 0644, p.OWRITE, "", false) }},
+	} {
+		tt.pack(tx)
+		rx, err = c.rpc(tx, 1)
+		if err != nil {
+			t.Fatalf("%s: %v\n", tt.name, err)
+		}
+		if rx.Type != p.Rerror {
+			t.Errorf("%s of an afid: got %v, expected an error\n", tt.name, rx)
+		}
+	}
+
+	p.PackTauth(tx, 3, "moe", "/", p.NOUID, false)
+	if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rauth {
+		t.Errorf("auth after using an afid: %v %v\n", rx, err)
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.Authenticator = NewSharedSecret("sesame")
+	})
+
+	// Attach as user with an afid that was sent secret.
+	attach := func(user, secret string) error {
+		afid, err := conn.Auth(user, "/")
+		if err != nil {
+			return err
+		}
+		defer afid.Close()
+		_, err = afid.Write([]byte(secret))
+		if err != nil {
+			return err
+		}
+		_, err = conn.Attach(afid, user, "/")
+		return err
+	}
+
+	err := attach("moe", "sesame")
+	if err != nil {
+		t.Errorf("attach with secret: %v\n", err)
+	}
+
+	err = attach("moe", "open sesame")
+	if err == nil || err.Error() != Eauth.Err {
+		t.Errorf("attach with wrong secret: got %v, expected %v\n", err, Eauth)
+	}
+
+	_, err = conn.Attach(nil, "moe", "/")
+	if err == nil || err.Error() != Eauth.Err {
+		t.Errorf("attach without afid: got %v, expected %v\n", err, Eauth)
+	}
+
+	// An afid authenticates only the user it was created for.
+	afid, err := conn.Auth("larry", "/")
+	if err != nil {
+		t.Fatalf("auth: %v\n", err)
+	}
+	defer afid.Close()
+	_, err = afid.Write([]byte("sesame"))
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	_, err = conn.Attach(afid, "moe", "/")
+	if err == nil || err.Error() != Eauth.Err {
+		t.Errorf("attach with larry's afid: got %v, expected %v\n", err, Eauth)
+	}
+	_, err = conn.Attach(afid, "larry", "/")
+	if err != nil {
+		t.Errorf("attach with larry's afid: %v\n", err)
+	}
+}
+
+func TestNoAuthRequired(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	_, err := conn.Auth("moe", "/")
+	if err == nil || err.Error() != srv.Enoauth.(*p.Error).Err {
+		t.Errorf("auth: got %v, expected %v\n", err, srv.Enoauth)
+	}
+}
@@ -0,0 +1,159 @@
+package vufs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Copy the file src to dst on behalf of the named user, without the
+// data passing through a client.  Paths are relative to the file
+// system root and found as a walk would find them.  The user needs
+// read permission on src and write permission on the directory dst
+// is created in; dst must not exist.
+// Like a file created with Tcreate, the copy is owned by the user and
+// takes the group of its directory.  It keeps the permissions, mode
+// bits and metadata of src.  Copy fails with Erofs if the file
+// system is read-only.  Other requests go on while the data is
+// copied; if the copy is removed meanwhile, Copy fails.
+func (u *VuFs) Copy(uname, src, dst string) (*p.Qid, error) {
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	if u.isReadOnly() {
+		return nil, Erofs
+	}
+
+	user := u.Upool.Uname2User(uname)
+	if user == nil {
+		return nil, ErrNoUser
+	}
+
+	dst = filepath.Join("/", dst)
+	err := validFilename(filepath.Base(dst))
+	if err != nil {
+		return nil, err
+	}
+
+	srcfn, ctl, err := u.resolve(user, src)
+	if err != nil {
+		return nil, err
+	}
+	dir, dirctl, err := u.resolve(user, filepath.Dir(dst))
+	if err != nil {
+		return nil, err
+	}
+	if ctl != ctlNone || dirctl != ctlNone {
+		return nil, ErrPerm
+	}
+	dstfn := dir + "/" + filepath.Base(dst)
+
+	// The user must be able to read the source ...
+	st, err := os.Stat(srcfn)
+	if err != nil {
+		return nil, osError(err)
+	}
+	if st.IsDir() {
+		return nil, srv.Ebaduse
+	}
+	store := u.store()
+	f, err := dir2Dir(srcfn, st, store)
+	if err != nil {
+		return nil, osError(err)
+	}
+	if !CheckPerm(f, user, p.DMREAD) {
+		return nil, ErrPerm
+	}
+	// Only its owner may read the users file, whatever its mode.
+	if u.isUsersFile(srcfn) && user.Name() != f.Uid {
+		return nil, ErrPerm
+	}
+
+	// ... and write to the destination directory.
+	dst1, err := os.Stat(dir)
+	if err != nil {
+		return nil, osError(err)
+	}
+	d, err := dir2Dir(dir, dst1, store)
+	if err != nil {
+		return nil, osError(err)
+	}
+	if !CheckPerm(d, user, p.DMWRITE) {
+		return nil, ErrPerm
+	}
+
+	// Copying would change whether the file is served decompressed.
+	if u.gzipped(srcfn) != u.gzipped(dstfn) {
+		return nil, Ecompressed
+	}
+
+	m, err := getMeta(store, srcfn)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := os.Open(srcfn)
+	if err != nil {
+		return nil, osError(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dstfn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode()&0777)
+	if err != nil {
+		return nil, osError(err)
+	}
+
+	// The copy counts against the user's quota.
+	size := st.Size()
+	err = u.chargeQuota(user.Name(), size)
+	if err != nil {
+		out.Close()
+		os.Remove(dstfn)
+		return nil, err
+	}
+
+	// Copy the data without holding up other requests.
+	u.tree.Unlock()
+	_, err = io.Copy(out, in)
+	ost, serr := out.Stat()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = serr
+	}
+	u.tree.Lock()
+
+	// Someone may have removed or replaced the copy meanwhile.
+	if err == nil {
+		st, err = os.Stat(dstfn)
+		if err == nil && !os.SameFile(st, ost) {
+			u.chargeQuota(user.Name(), -size)
+			return nil, ErrNotExist
+		}
+	}
+	if err == nil {
+		// The umask may have cleared some permission bits.
+		err = os.Chmod(dstfn, st.Mode()&0777)
+	}
+	if err == nil {
+		m.Uid, m.Gid, m.Muid = user.Name(), u.newFileGroup(user, d.Gid), user.Name()
+		err = store.Set(dstfn, m)
+	}
+	if err == nil {
+		st, err = os.Stat(dstfn)
+	}
+	if err != nil {
+		os.Remove(dstfn)
+		u.chargeQuota(user.Name(), -size)
+		return nil, osError(err)
+	}
+
+	qid := dir2Qid(st)
+	qid.Type |= uint8((m.Mode & metaModeBits) >> 24)
+
+	return qid, nil
+}
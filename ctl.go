@@ -0,0 +1,88 @@
+package vufs
+
+import (
+	"os"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// If VuFs.Ctl is set, the root holds a synthetic, read-only
+// directory that is not on disk:
+//
+//	/ctl/groups	the groups of the user reading it, one per line
+//
+// It is not listed in the root and hides any ctl on disk there.
+const ctlName = "ctl"
+
+// Which synthetic file a fid refers to.
+const (
+	ctlNone = iota
+	ctlDir
+	ctlGroups
+)
+
+// Qid paths for the synthetic files, well above any inode number.
+const ctlQidPath = 1 << 62
+
+func ctlQid(kind int) p.Qid {
+	q := p.Qid{Path: ctlQidPath + uint64(kind)}
+	if kind == ctlDir {
+		q.Type = p.QTDIR
+	}
+	return q
+}
+
+// Walk one name from a synthetic file, or from the root if kind
+// is ctlNone.  Ok is false if there is no such file.
+func (u *VuFs) ctlWalk(kind int, name string) (qid p.Qid, next int, ok bool) {
+	switch {
+	case kind == ctlNone && name == ctlName:
+		return ctlQid(ctlDir), ctlDir, true
+	case kind == ctlDir && name == "groups":
+		return ctlQid(ctlGroups), ctlGroups, true
+	case kind == ctlDir && name == "..":
+		st, err := os.Stat(u.Root)
+		if err != nil {
+			return qid, 0, false
+		}
+		return *dir2Qid(st), ctlNone, true
+	}
+	return qid, 0, false
+}
+
+// Return the stat of a synthetic file.
+func ctlStat(kind int) *p.Dir {
+	dir := new(p.Dir)
+	dir.Qid = ctlQid(kind)
+	dir.Uid, dir.Gid, dir.Muid = "adm", "adm", "adm"
+	dir.Uidnum, dir.Gidnum, dir.Muidnum = p.NOUID, p.NOUID, p.NOUID
+	dir.Atime = uint32(time.Now().Unix())
+	dir.Mtime = dir.Atime
+	switch kind {
+	case ctlDir:
+		dir.Name = ctlName
+		dir.Mode = p.DMDIR | 0555
+	case ctlGroups:
+		dir.Name = "groups"
+		dir.Mode = 0444
+	}
+	return dir
+}
+
+// Return the contents of a synthetic file for user.
+func ctlData(kind int, user p.User) []byte {
+	var data []byte
+	if kind == ctlGroups && user != nil {
+		for _, g := range user.Groups() {
+			data = append(data, g.Name()+"\n"...)
+		}
+	}
+	return data
+}
+
+// Pack the entries of the ctl directory.
+func ctlPackDir(dotu bool) ([]byte, []int) {
+	dirents := p.PackDir(ctlStat(ctlGroups), dotu)
+	return dirents, []int{len(dirents)}
+}
@@ -0,0 +1,42 @@
+package vufs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mbucc/vufs"
+)
+
+// The vufs command reloads adm/users this way when it gets SIGHUP.
+func ExampleVuFs_ReloadUsers() {
+	root, err := ioutil.TempDir("", "vufs")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	users := filepath.Join(root, "adm", "users")
+	os.Mkdir(filepath.Dir(users), 0700)
+	ioutil.WriteFile(users, []byte("1:adm:adm\n"), 0600)
+
+	upool, err := vufs.NewVusers(root, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fs := vufs.New(root, vufs.WithUsers(upool))
+
+	// An admin adds glenda.
+	ioutil.WriteFile(users, []byte("1:adm:adm\n2:glenda:glenda\n"), 0600)
+	fmt.Println(fs.Upool.Uname2User("glenda") != nil)
+
+	err = fs.ReloadUsers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(fs.Upool.Uname2User("glenda") != nil)
+	// Output:
+	// false
+	// true
+}
@@ -0,0 +1,107 @@
+package vufs
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Returned when a client tries to modify a gzip-compressed file.
+var Ecompressed = &p.Error{"compressed file is read-only", p.EPERM}
+
+// Returned when a gzip-compressed file decompresses to more than
+// MaxGunzip bytes.
+var Egziptoolarge = &p.Error{"decompressed file too large", uint32(syscall.EFBIG)}
+
+const defaultMaxGunzip = 64 << 20
+
+func (u *VuFs) maxGunzip() int64 {
+	if u.MaxGunzip > 0 {
+		return u.MaxGunzip
+	}
+	return defaultMaxGunzip
+}
+
+// Report whether the file at path is served decompressed.
+func (u *VuFs) gzipped(path string) bool {
+	return u.GzipSuffix != "" && strings.HasSuffix(path, u.GzipSuffix)
+}
+
+// Return the decompressed contents of a gzip file, or
+// Egziptoolarge if there are more than max bytes of them.
+func gunzip(file *os.File, max int64) ([]byte, error) {
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, toError(err)
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(zr, max+1))
+	if err != nil {
+		return nil, toError(err)
+	}
+	if int64(len(data)) > max {
+		return nil, Egziptoolarge
+	}
+	return data, nil
+}
+
+// The smallest gzip file: a header and a trailer.
+const gzipMin = 18
+
+// Return the decompressed length of a gzip file, as stat reports
+// it.  This is the ISIZE field in the last four bytes of the file,
+// so it is cheap, but it is only the length of the last member of
+// the file, modulo 2^32.  It is wrong for files of several members,
+// as cat makes from gzip files, and for files of 4GB or more; both
+// still read in full.  A file too short to have a trailer, such as
+// one still being written, reports its size on disk; opening it
+// fails.
+func gzipLength(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	st, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if st.Size() < gzipMin {
+		return uint64(st.Size()), nil
+	}
+
+	var isize [4]byte
+	_, err = file.ReadAt(isize[:], st.Size()-4)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(binary.LittleEndian.Uint32(isize[:])), nil
+}
+
+// Convert a file to a p.Dir, reporting the decompressed length
+// of gzip files.
+func (u *VuFs) dir2Dir(path string, d os.FileInfo) (*p.Dir, error) {
+	dir, err := dir2Dir(path, d, u.store())
+	if err != nil {
+		return nil, err
+	}
+	u.setDotu(path, dir)
+
+	if !d.IsDir() && u.gzipped(path) {
+		dir.Length, err = gzipLength(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dir, nil
+}
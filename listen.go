@@ -0,0 +1,617 @@
+package vufs
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// A net.Conn accepted by VuFs.StartListener.  go9p does not close
+// the socket when a client goes away, so VuFs closes it in ConnClosed.
+// The connection is found from the srv.Conn through its remote
+// address, which go9p asks the net.Conn for.
+//
+// go9p panics on a message whose fields run past its end, which
+// would take down the server, so reads return whole messages and
+// fail on one go9p cannot unpack.
+type trackedConn struct {
+	net.Conn
+	addr connAddr
+
+	// If not zero, reads fail once the client has sent nothing
+	// for this long, and go9p closes the connection.
+	idle time.Duration
+
+	// If not zero, a write fails when the client has not taken
+	// it after this long, and go9p closes the connection.
+	wtimeout time.Duration
+
+	// The go9p connection, set in ConnOpened, and the largest
+	// message the client may send, checked before anything is
+	// allocated for it.
+	conn  *srv.Conn
+	msize uint32
+
+	// The last message read and the part of it not yet returned.
+	buf []byte
+	msg []byte
+}
+
+type connAddr struct {
+	net.Addr
+	c *trackedConn
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return &c.addr
+}
+
+// Some connections, such as a net.Conn from a proxy, may have no
+// address.
+func (a *connAddr) Network() string {
+	if a.Addr == nil {
+		return ""
+	}
+	return a.Addr.Network()
+}
+
+func (a *connAddr) String() string {
+	if a.Addr == nil {
+		return ""
+	}
+	return a.Addr.String()
+}
+
+// Return the address of the client on conn, or "" if it has none.
+func remoteAddr(conn *srv.Conn) string {
+	a := conn.RemoteAddr()
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	if len(c.msg) == 0 {
+		err := c.readMsg()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.msg)
+	c.msg = c.msg[n:]
+	return n, nil
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	if c.wtimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.wtimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// The size of a message's size, type and tag.
+const hdrsz = 4 + 1 + 2
+
+// Read the client's next message into msg.
+func (c *trackedConn) readMsg() error {
+	if c.idle > 0 {
+		c.SetReadDeadline(time.Now().Add(c.idle))
+	}
+
+	var size [4]byte
+	_, err := io.ReadFull(c.Conn, size[:])
+	if err != nil {
+		return err
+	}
+	n, _ := p.Gint32(size[:])
+	if n < hdrsz || n > c.msize {
+		return Ebadmsg
+	}
+
+	if len(c.buf) < int(n) {
+		c.buf = make([]byte, n)
+	}
+	msg := c.buf[:n]
+	copy(msg, size[:])
+	_, err = io.ReadFull(c.Conn, msg[len(size):])
+	if err != nil {
+		return err
+	}
+
+	// Only this goroutine changes Dotu, when go9p handles Tversion.
+	dotu := c.conn != nil && c.conn.Dotu
+	if !unpacks(msg, dotu) {
+		return Ebadmsg
+	}
+	c.msg = msg
+	return nil
+}
+
+// Report whether go9p can unpack msg.
+func unpacks(msg []byte, dotu bool) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	_, err, _ := p.Unpack(msg, dotu)
+	return err == nil
+}
+
+func newTrackedConn(c net.Conn) *trackedConn {
+	tc := &trackedConn{Conn: c}
+	tc.addr = connAddr{c.RemoteAddr(), tc}
+	return tc
+}
+
+// Return the net.Conn behind a go9p connection, if VuFs accepted it.
+func netConn(conn *srv.Conn) *trackedConn {
+	if a, ok := conn.RemoteAddr().(*connAddr); ok {
+		return a.c
+	}
+	return nil
+}
+
+// Returned by StartListener when the server has been stopped.
+var Estopped = &p.Error{"server stopped", p.EIO}
+
+// Why a connection is closed when its client sends a message that is
+// too large or malformed.
+var Ebadmsg = &p.Error{"bad message", p.EINVAL}
+
+// Serve 9P on connections accepted from l until l is closed or the
+// server is stopped.  If the last listener fails, the server stops
+// taking connections, but those it has stay open.
+func (u *VuFs) StartListener(l net.Listener) error {
+	if !u.addListener(l) {
+		l.Close()
+		return Estopped
+	}
+	defer u.removeListener(l)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if u.isStopped() {
+				return Estopped
+			}
+			return &p.Error{err.Error(), p.EIO}
+		}
+
+		u.setKeepAlive(c)
+		tc := newTrackedConn(c)
+		tc.idle = u.IdleTimeout
+		tc.wtimeout = u.WriteTimeout
+		tc.msize = u.Msize
+		if tc.msize > maxMsize {
+			tc.msize = maxMsize
+		}
+		if !u.addConn(tc) {
+			c.Close()
+			return Estopped
+		}
+		u.NewConn(tc)
+	}
+}
+
+// The keepalive methods of *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// Turn on keepalives for c if it is a TCP connection, or TLS over
+// one, and KeepAlive is set.
+func (u *VuFs) setKeepAlive(c net.Conn) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	kc, ok := c.(keepAliveConn)
+	if !ok || u.KeepAlive <= 0 {
+		return
+	}
+	err := kc.SetKeepAlive(true)
+	if err == nil {
+		err = kc.SetKeepAlivePeriod(u.KeepAlive)
+	}
+	if err != nil {
+		u.logf("keepalive %s: %v", c.RemoteAddr(), err)
+	}
+}
+
+// The largest message VuFs accepts, whatever Msize is.
+const maxMsize = 8<<20 + p.IOHDRSZ
+
+// Start the file system with ops (usually the VuFs itself).  An
+// Msize over maxMsize is lowered to it, and users made by NewVusers
+// must keep Owner from then on.
+func (u *VuFs) Start(ops interface{}) bool {
+	u.mu.Lock()
+	u.started = true
+	u.mu.Unlock()
+
+	if u.Msize > maxMsize {
+		u.Msize = maxMsize
+	}
+	if up, ok := u.Upool.(*vUsers); ok {
+		up.setOwner(u.Owner)
+	}
+
+	return u.Srv.Start(ops)
+}
+
+// Stop serving: close the listeners and, once the requests being
+// handled are answered, the client connections.  Stop can be called
+// more than once, and before the server starts.
+func (u *VuFs) Stop() {
+	u.StopWithContext(context.Background())
+}
+
+// Stop serving as Stop does, but if ctx is done first, close the
+// client connections without waiting for requests and return ctx's
+// error.  Otherwise StopWithContext returns nil once the listeners
+// and connections have closed.
+func (u *VuFs) StopWithContext(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.stopped {
+		u.stop()
+	}
+	listeners := make([]net.Listener, 0, len(u.listeners))
+	for l := range u.listeners {
+		listeners = append(listeners, l)
+	}
+	u.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	err := u.waitReqs(ctx)
+
+	u.mu.Lock()
+	conns := make([]*trackedConn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		u.running.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Block until the server has stopped, by Stop or because its last
+// listener failed, and all its connections have closed.  Wait
+// returns at once if the server was never started.
+func (u *VuFs) Wait() {
+	u.mu.Lock()
+	if !u.started {
+		u.mu.Unlock()
+		return
+	}
+	done := u.doneChan()
+	u.mu.Unlock()
+
+	<-done
+	u.running.Wait()
+}
+
+// Return the channel closed when the server stops.  The caller
+// holds mu.
+func (u *VuFs) doneChan() chan struct{} {
+	if u.done == nil {
+		u.done = make(chan struct{})
+	}
+	return u.done
+}
+
+// Mark the server stopped.  The caller holds mu.
+func (u *VuFs) stop() {
+	u.stopped = true
+	close(u.doneChan())
+}
+
+// Note that a request is being handled until endReq.
+func (u *VuFs) beginReq() {
+	u.mu.Lock()
+	u.reqs++
+	u.mu.Unlock()
+}
+
+func (u *VuFs) endReq() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.reqs--
+	if u.reqs == 0 && u.reqsDone != nil {
+		close(u.reqsDone)
+		u.reqsDone = nil
+	}
+}
+
+// Wait until no requests are being handled, or ctx is done.
+func (u *VuFs) waitReqs(ctx context.Context) error {
+	u.mu.Lock()
+	if u.reqs == 0 {
+		u.mu.Unlock()
+		return nil
+	}
+	if u.reqsDone == nil {
+		u.reqsDone = make(chan struct{})
+	}
+	done := u.reqsDone
+	u.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (u *VuFs) isStopped() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.stopped
+}
+
+// Track a listener for Stop and Wait, reporting false if already
+// stopped.
+func (u *VuFs) addListener(l net.Listener) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stopped {
+		return false
+	}
+	if u.listeners == nil {
+		u.listeners = make(map[net.Listener]bool)
+	}
+	u.listeners[l] = true
+	u.running.Add(1)
+	return true
+}
+
+func (u *VuFs) removeListener(l net.Listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.listeners[l] {
+		return
+	}
+	delete(u.listeners, l)
+	if len(u.listeners) == 0 && !u.stopped {
+		u.stop()
+	}
+	u.running.Done()
+}
+
+// Track a connection for Stop and Wait, reporting false if already
+// stopped.
+func (u *VuFs) addConn(c *trackedConn) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stopped {
+		return false
+	}
+	if u.conns == nil {
+		u.conns = make(map[*trackedConn]bool)
+	}
+	u.conns[c] = true
+	u.running.Add(1)
+	return true
+}
+
+func (u *VuFs) removeConn(c *trackedConn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.conns[c] {
+		return
+	}
+	delete(u.conns, c)
+	u.running.Done()
+}
+
+// Listen on the network address.  For a unix socket, a stale socket
+// file left by an earlier server is removed first, but not one a
+// server still answers on.  The new socket is accessible only by
+// its owner: it is made in a private directory next to addr, where
+// no one else can reach it, and moved into place once its mode is
+// set.  Closing the listener removes the socket file.
+func listen(ntype, addr string) (net.Listener, error) {
+	if ntype != "unix" {
+		return net.Listen(ntype, addr)
+	}
+
+	st, err := os.Lstat(addr)
+	if err == nil && st.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", addr)
+		if err == nil {
+			c.Close()
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			os.Remove(addr)
+		}
+	}
+
+	// Fail as Listen would if addr is taken.
+	if _, err = os.Lstat(addr); err == nil {
+		return nil, &net.OpError{Op: "listen", Net: ntype,
+			Addr: &net.UnixAddr{Name: addr, Net: ntype}, Err: syscall.EADDRINUSE}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(addr), ".9p")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix(ntype, &net.UnixAddr{Name: tmp, Net: ntype})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		err = os.Rename(tmp, addr)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{UnixListener: l, path: addr, unlink: true}, nil
+}
+
+// A unix socket listener whose socket file was moved after it was
+// made, so it must remove the file itself.
+type unixListener struct {
+	*net.UnixListener
+	path string
+
+	mu     sync.Mutex
+	unlink bool
+}
+
+// Choose whether Close removes the socket file, as the
+// net.UnixListener method does.
+func (l *unixListener) SetUnlinkOnClose(unlink bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.unlink = unlink
+}
+
+func (l *unixListener) Close() error {
+	l.mu.Lock()
+	unlink := l.unlink
+	l.unlink = false
+	l.mu.Unlock()
+
+	err := l.UnixListener.Close()
+	if unlink {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// Listen on the network address and serve 9P on it.
+func (u *VuFs) StartNetListener(ntype, addr string) error {
+	l, err := listen(ntype, addr)
+	if err != nil {
+		return &p.Error{err.Error(), p.EIO}
+	}
+
+	return u.StartListener(l)
+}
+
+// Serve 9P on the listening socket fd, as StartListener does.  The
+// socket is usually one a previous server passed on with Handoff.
+// StartFromFd takes ownership of fd, which must not also belong to
+// an os.File.
+func (u *VuFs) StartFromFd(fd uintptr) error {
+	f := os.NewFile(fd, "listener")
+	if f == nil {
+		return &p.Error{"bad listener fd", p.EINVAL}
+	}
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return &p.Error{err.Error(), p.EIO}
+	}
+
+	return u.StartListener(l)
+}
+
+// A listener whose socket can be passed to another process.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// Stop taking connections and return the listening sockets, for
+// another process to serve with StartFromFd (for example, passed in
+// exec.Cmd's ExtraFiles).  Unlike Stop, the connections the server
+// has stay open until their clients close them; Wait returns after
+// the last.  StartListener returns Estopped.  Nothing is stopped if
+// a listener, such as a TLS one, has no socket to pass on.
+func (u *VuFs) Handoff() ([]*os.File, error) {
+	u.mu.Lock()
+	listeners := make([]net.Listener, 0, len(u.listeners))
+	for l := range u.listeners {
+		listeners = append(listeners, l)
+	}
+	u.mu.Unlock()
+
+	files := make([]*os.File, 0, len(listeners))
+	for _, l := range listeners {
+		fl, ok := l.(fileListener)
+		var f *os.File
+		var err error
+		if ok {
+			f, err = fl.File()
+		} else {
+			err = &p.Error{"listener cannot be handed off", p.EINVAL}
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	u.mu.Lock()
+	if !u.stopped {
+		u.stop()
+	}
+	u.mu.Unlock()
+
+	for _, l := range listeners {
+		// The socket file must stay for the next server.
+		if ul, ok := l.(interface{ SetUnlinkOnClose(bool) }); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+
+	return files, nil
+}
+
+// Listen on the network address and serve 9P over TLS.  Client
+// certificates can be required and verified by setting ClientAuth
+// and ClientCAs in cfg.
+func (u *VuFs) StartTLS(ntype, addr string, cfg *tls.Config) error {
+	l, err := listen(ntype, addr)
+	if err != nil {
+		return &p.Error{err.Error(), p.EIO}
+	}
+
+	return u.StartListener(tls.NewListener(l, cfg))
+}
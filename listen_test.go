@@ -0,0 +1,789 @@
+package vufs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9/client"
+	"github.com/lionkov/go9p/p"
+)
+
+// Wait up to a couple of seconds for the number of goroutines
+// to drop to n.
+func waitGoroutines(n int) int {
+	var now int
+	for i := 0; i < 40; i++ {
+		now = runtime.NumGoroutine()
+		if now <= n {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return now
+}
+
+func TestClientGoesAway(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+	conn.Close()
+	time.Sleep(250 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for _, data := range []string{
+		"",                  // clean close
+		"\x00\x00",          // half a size field
+		"\x20\x00\x00\x00",  // size but no message
+		"\xff\xff\xff\x7fx", // larger than msize
+	} {
+		c, err := net.Dial("tcp", port)
+		if err != nil {
+			t.Fatalf("dial: %v\n", err)
+		}
+		if data != "" {
+			c.Write([]byte(data))
+		}
+		c.Close()
+
+		if n := waitGoroutines(before); n > before {
+			t.Errorf("%q: %d goroutines still running, expected %d\n", data, n, before)
+		}
+	}
+
+	// When the client half-closes, the server closes its end too.
+	c, err := net.Dial("tcp", port)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+	c.(*net.TCPConn).CloseWrite()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("read after half-close: got %v, expected EOF\n", err)
+	}
+}
+
+func TestStartListener(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vufs-sock")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The caller creates the listener, here on a unix socket.
+	sock := filepath.Join(dir, "9p")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	defer l.Close()
+
+	fs := newfs(rootdir)
+	fs.Start(fs)
+	go fs.StartListener(l)
+
+	conn, err := client.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	defer conn.Close()
+
+	contents, err := read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if contents != initialFiles["/moe-moe.txt"].contents {
+		t.Errorf("read '%s', expected '%s'\n", contents, initialFiles["/moe-moe.txt"].contents)
+	}
+}
+
+// Return a self-signed certificate for localhost.
+func selfSignedCert() (tls.Certificate, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, nil
+}
+
+func TestStartTLS(t *testing.T) {
+
+	const tlsport = "localhost:5002"
+
+	cert, x509cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatalf("selfSignedCert: %v\n", err)
+	}
+
+	fs := newfs(rootdir)
+	fs.Start(fs)
+	go fs.StartTLS("tcp", tlsport, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(x509cert)
+	var c *tls.Conn
+	for i := 0; i < 20; i++ {
+		c, err = tls.Dial("tcp", tlsport, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("tls.Dial: %v\n", err)
+	}
+
+	// NewConn does the version handshake.
+	conn, err := client.NewConn(c)
+	if err != nil {
+		t.Fatalf("NewConn: %v\n", err)
+	}
+	defer conn.Close()
+
+	contents, err := read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if contents != initialFiles["/moe-moe.txt"].contents {
+		t.Errorf("read '%s', expected '%s'\n", contents, initialFiles["/moe-moe.txt"].contents)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vufs-sock")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "9p")
+
+	// Leave a stale socket file behind.
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	l, err = listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen over stale socket: %v\n", err)
+	}
+	st, err := os.Stat(sock)
+	if err != nil {
+		t.Fatalf("Stat: %v\n", err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %o, expected 0600\n", st.Mode().Perm())
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil || len(names) != 1 {
+		t.Errorf("socket dir has %d entries (%v), expected 1\n", len(names), err)
+	}
+
+	fs := newfs(rootdir)
+	fs.Start(fs)
+	go fs.StartListener(l)
+
+	conn, err := client.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	_, err = read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Errorf("read: %v\n", err)
+	}
+	conn.Close()
+
+	// A second server can't take the socket of a live one.
+	if l2, err := listen("unix", sock); err == nil {
+		l2.Close()
+		t.Error("listen took over a live socket")
+	}
+	conn, err = client.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial after second listen: %v\n", err)
+	}
+	conn.Close()
+
+	// Closing the listener removes the socket.
+	l.Close()
+	if _, err = os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on close: %v\n", err)
+	}
+
+	// Other files are never removed.
+	err = ioutil.WriteFile(sock, nil, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	if l, err = listen("unix", sock); err == nil {
+		l.Close()
+		t.Error("listen replaced a regular file")
+	}
+}
+
+func TestStop(t *testing.T) {
+
+	// Stopping a server that never started is harmless.
+	fs := newfs(rootdir)
+	fs.Stop()
+	fs.Stop()
+
+	fs = newfs(rootdir)
+	fs.Start(fs)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	done := make(chan error)
+	go func() { done <- fs.StartListener(l) }()
+
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	defer conn.Close()
+	_, err = read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+
+	fs.Stop()
+	fs.Stop()
+
+	select {
+	case err = <-done:
+		if err != Estopped {
+			t.Errorf("StartListener returned %v, expected %v\n", err, Estopped)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartListener still running after Stop")
+	}
+
+	// Clients are disconnected and no more are accepted.
+	if _, err = read(conn, "moe", "/moe-moe.txt"); err == nil {
+		t.Error("read after Stop")
+	}
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Error("dial after Stop")
+	}
+	l, err = net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	if err = fs.StartListener(l); err != Estopped {
+		t.Errorf("StartListener after Stop returned %v, expected %v\n", err, Estopped)
+	}
+}
+
+func TestWait(t *testing.T) {
+
+	// A server that never started has nothing to wait for.
+	fs := newfs(rootdir)
+	fs.Wait()
+
+	fs = newfs(rootdir)
+	fs.Start(fs)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	go fs.StartListener(l)
+
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	defer conn.Close()
+	_, err = read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+
+	waited := make(chan bool)
+	go func() {
+		fs.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while serving")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	go fs.Stop()
+	select {
+	case <-waited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait still blocked after Stop")
+	}
+
+	// Once stopped, Wait returns at once.
+	fs.Wait()
+}
+
+func TestIdleTimeout(t *testing.T) {
+
+	fs := newfs(rootdir)
+	fs.IdleTimeout = 200 * time.Millisecond
+	fs.Start(fs)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	defer fs.Stop()
+	go fs.StartListener(l)
+
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	defer conn.Close()
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+
+	// A busy connection stays open.
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err = fsys.Stat("/moe-moe.txt"); err != nil {
+			t.Fatalf("stat %d: %v\n", i, err)
+		}
+	}
+
+	// An idle one is dropped.
+	time.Sleep(500 * time.Millisecond)
+	if _, err = fsys.Stat("/moe-moe.txt"); err == nil {
+		t.Error("stat after idle timeout")
+	}
+}
+
+// A listener that accepts connections sent on conns.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, io.EOF
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestWriteTimeout(t *testing.T) {
+
+	fs := newfs(rootdir)
+	fs.WriteTimeout = 200 * time.Millisecond
+	fs.Start(fs)
+	l := newPipeListener()
+	defer fs.Stop()
+	go fs.StartListener(l)
+
+	// The client sends a Tversion but never reads the reply.
+	client, server := net.Pipe()
+	defer client.Close()
+	l.conns <- server
+	tx := p.NewFcall(8192)
+	p.PackTversion(tx, 8192, "9P2000")
+	_, err := client.Write(tx.Pkt)
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+
+	conns := func() int {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return len(fs.conns)
+	}
+	if n := conns(); n != 1 {
+		t.Fatalf("%d connections, expected 1\n", n)
+	}
+	for i := 0; i < 40 && conns() != 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := conns(); n != 0 {
+		t.Errorf("%d connections after the write timeout, expected 0\n", n)
+	}
+	if _, err = client.Write(tx.Pkt); err == nil {
+		t.Error("write to a timed out connection\n")
+	}
+}
+
+// A connection that records the keepalive it is given, as a TCP
+// connection would have.
+type keepAlivePipe struct {
+	net.Conn
+	mu     sync.Mutex
+	on     bool
+	period time.Duration
+}
+
+func (c *keepAlivePipe) SetKeepAlive(on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.on = on
+	return nil
+}
+
+func (c *keepAlivePipe) SetKeepAlivePeriod(d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.period = d
+	return nil
+}
+
+func TestKeepAlive(t *testing.T) {
+
+	fs := newfs(rootdir)
+	fs.KeepAlive = 30 * time.Second
+	fs.Start(fs)
+	l := newPipeListener()
+	defer fs.Stop()
+	go fs.StartListener(l)
+
+	c, server := net.Pipe()
+	defer c.Close()
+	kc := &keepAlivePipe{Conn: server}
+	l.conns <- kc
+
+	// The connection is set up before the next one is accepted.
+	other, server := net.Pipe()
+	defer other.Close()
+	l.conns <- server
+
+	kc.mu.Lock()
+	on, period := kc.on, kc.period
+	kc.mu.Unlock()
+	if !on || period != fs.KeepAlive {
+		t.Errorf("keepalive %v every %v, expected on every %v\n", on, period, fs.KeepAlive)
+	}
+
+	// A connection under TLS takes it too.
+	cert, _, err := selfSignedCert()
+	if err != nil {
+		t.Fatalf("cert: %v\n", err)
+	}
+	c, server = net.Pipe()
+	defer c.Close()
+	kc = &keepAlivePipe{Conn: server}
+	l.conns <- tls.Server(kc, &tls.Config{Certificates: []tls.Certificate{cert}})
+	other, server = net.Pipe()
+	defer other.Close()
+	l.conns <- server
+
+	kc.mu.Lock()
+	on, period = kc.on, kc.period
+	kc.mu.Unlock()
+	if !on || period != fs.KeepAlive {
+		t.Errorf("TLS keepalive %v every %v, expected on every %v\n", on, period, fs.KeepAlive)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+
+	old := newfs(rootdir)
+	old.Start(old)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- old.StartListener(l) }()
+
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+
+	files, err := old.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff: %v\n", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Handoff returned %d files, expected 1\n", len(files))
+	}
+	if err = <-stopped; err != Estopped {
+		t.Errorf("StartListener returned %v, expected %v\n", err, Estopped)
+	}
+
+	// Only the new server has /ctl.
+	fs := New(rootdir, WithUsers(old.Upool))
+	fs.Id = "vufs"
+	fs.Ctl = true
+	fs.Start(fs)
+	defer fs.Stop()
+	// As a new process would, serve a descriptor of its own.
+	fd, err := syscall.Dup(int(files[0].Fd()))
+	files[0].Close()
+	if err != nil {
+		t.Fatalf("Dup: %v\n", err)
+	}
+	go fs.StartFromFd(uintptr(fd))
+
+	conn2, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial after handoff: %v\n", err)
+	}
+	defer conn2.Close()
+	fsys2, err := conn2.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach after handoff: %v\n", err)
+	}
+	if _, err = fsys2.Stat("/ctl"); err != nil {
+		t.Errorf("new connection not served by the new server: %v\n", err)
+	}
+
+	// The old connection is still served by the old server.
+	if _, err = fsys.Stat("/moe-moe.txt"); err != nil {
+		t.Errorf("stat on the old connection: %v\n", err)
+	}
+	if _, err = fsys.Stat("/ctl"); err == nil {
+		t.Error("old connection served by the new server")
+	}
+
+	// The old server is done when its last client goes.
+	waited := make(chan bool)
+	go func() {
+		old.Wait()
+		close(waited)
+	}()
+	conn.Close()
+	select {
+	case <-waited:
+	case <-time.After(2 * time.Second):
+		t.Error("old server still waiting after its last client left")
+	}
+}
+
+func TestStopWithContext(t *testing.T) {
+
+	fs := newfs(rootdir)
+	fs.Start(fs)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	go fs.StartListener(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	defer c.Close()
+	rc := &rawConn{c, 8192, false}
+	tx := p.NewFcall(rc.msize)
+	p.PackTversion(tx, rc.msize, "9P2000")
+	rx, err := rc.rpc(tx, p.NOTAG)
+	if err != nil || rx.Type != p.Rversion {
+		t.Fatalf("version: %v %v\n", rx, err)
+	}
+	p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, false)
+	rx, err = rc.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+
+	// Wedge a stat by holding the tree.
+	fs.tree.Lock()
+	defer fs.tree.Unlock()
+	p.PackTstat(tx, 1)
+	err = rc.send(tx, 1)
+	if err != nil {
+		t.Fatalf("send: %v\n", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = fs.StopWithContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("StopWithContext: got %v, expected %v\n", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("StopWithContext took %v\n", d)
+	}
+
+	// The connection was closed anyway.
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("read after StopWithContext: got %v, expected EOF\n", err)
+	}
+}
+
+// Return truncations of some packed T-messages, their sizes fixed up
+// to match.
+func truncatedMsgs() [][]byte {
+	tx := p.NewFcall(8192)
+	var pkts [][]byte
+	for _, pack := range []func(){
+		func() { p.PackTattach(tx, 1, p.NOFID, "moe", "/", 3, true) },
+		func() { p.PackTwalk(tx, 1, 2, []string{"a", "b"}) },
+		func() { p.PackTcreate(tx, 1, "new", 0644, p.OWRITE, "ext", true) },
+		func() { p.PackTwrite(tx, 1, 0, 4, []byte("data")) },
+		func() {
+			d := p.Dir{Name: "x", Uid: "moe", Gid: "moe", Muid: "moe", Ext: "ext"}
+			p.PackTwstat(tx, 1, &d, true)
+		},
+	} {
+		pack()
+		pkts = append(pkts, append([]byte(nil), tx.Pkt...))
+	}
+
+	var msgs [][]byte
+	for _, pkt := range pkts {
+		for n := hdrsz; n < len(pkt); n++ {
+			msg := append([]byte(nil), pkt[:n]...)
+			msg[0], msg[1], msg[2], msg[3] = byte(n), byte(n>>8), 0, 0
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func TestUnpacks(t *testing.T) {
+	refused := 0
+	for _, msg := range truncatedMsgs() {
+		if !unpacks(msg, true) {
+			refused++
+			continue
+		}
+		// This would panic if unpacks were wrong.
+		p.Unpack(msg, true)
+	}
+	if refused == 0 {
+		t.Error("no truncated message was refused\n")
+	}
+}
+
+func TestBadMessages(t *testing.T) {
+
+	runserver(rootdir, port)
+
+	for _, msg := range truncatedMsgs() {
+		c, err := dialRawVersion(8192, "9P2000.u")
+		if err != nil {
+			t.Fatalf("dial: %v\n", err)
+		}
+		c.Write(msg)
+
+		// Wait for a reply, if the message was good, or for the
+		// server to hang up.
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		c.Read(make([]byte, 1))
+		c.Close()
+	}
+
+	// The server is still there.
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Errorf("attach: %v %v\n", rx, err)
+	}
+}
+
+func TestOversizedMessage(t *testing.T) {
+
+	fs := newfs(rootdir)
+	fs.Msize = 1 << 30
+	fs.Start(fs)
+	if fs.Msize != maxMsize {
+		t.Errorf("Msize %d, expected %d\n", fs.Msize, maxMsize)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	defer fs.Stop()
+	go fs.StartListener(l)
+
+	// Before any Tversion, claim a message of nearly 2GB.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v\n", err)
+	}
+	defer c.Close()
+	c.Write([]byte("\xff\xff\xff\x7f\x64\xff\xff"))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("read after oversized message: got %v, expected the connection closed\n", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<30 {
+		t.Errorf("%d bytes allocated for an oversized message\n", n)
+	}
+}
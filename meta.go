@@ -0,0 +1,95 @@
+package vufs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Keys for per-file metadata an HTTP gateway can use to serve
+// correct headers.  With the default store, metadata is kept as
+// key=value columns on the file's line in its directory's .uidgid
+// file, e.g.
+//
+//	index.html:2:3:cache=max-age=3600:type=text/html
+//
+// so a gateway can read it over 9P along with the ownership.
+const (
+	ContentType  = "type"
+	CacheControl = "cache"
+)
+
+// Attributes that are managed by the server and cannot be set with SetMeta.
+var reservedAttrs = map[string]bool{"mode": true, "muid": true}
+
+// Return the metadata for a file.  The path is relative to the
+// file system root.
+func (u *VuFs) Meta(path string) (map[string]string, error) {
+	u.tree.RLock()
+	defer u.tree.RUnlock()
+
+	fn, ctl, err := u.resolve(nil, path)
+	if err != nil {
+		return nil, err
+	}
+	if ctl != ctlNone {
+		return nil, ErrPerm
+	}
+
+	m, err := getMeta(u.store(), fn)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]string, len(m.Attrs))
+	for k, v := range m.Attrs {
+		if !reservedAttrs[k] {
+			meta[k] = v
+		}
+	}
+	return meta, nil
+}
+
+// Set a metadata value for a file; an empty value removes the key.
+// The path is relative to the file system root.
+func (u *VuFs) SetMeta(path, key, value string) error {
+	if key == "" || reservedAttrs[key] || strings.ContainsAny(key, ":=\n") {
+		return fmt.Errorf("invalid metadata key '%s'", key)
+	}
+	if strings.ContainsAny(value, ":\n") {
+		return fmt.Errorf("invalid metadata value '%s'", value)
+	}
+
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	if u.isReadOnly() {
+		return Erofs
+	}
+
+	fn, ctl, err := u.resolve(nil, path)
+	if err != nil {
+		return err
+	}
+	if ctl != ctlNone {
+		return ErrPerm
+	}
+
+	store := u.store()
+	m, err := getMeta(store, fn)
+	if err != nil {
+		return err
+	}
+
+	attrs := make(map[string]string, len(m.Attrs)+1)
+	for k, v := range m.Attrs {
+		attrs[k] = v
+	}
+	if value == "" {
+		delete(attrs, key)
+	} else {
+		attrs[key] = value
+	}
+	m.Attrs = attrs
+
+	return store.Set(fn, m)
+}
@@ -0,0 +1,81 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"9fans.net/go/plan9"
+)
+
+func TestContentType(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	err := fs.SetMeta("/moe-moe.txt", ContentType, "text/plain; charset=utf-8")
+	if err != nil {
+		t.Fatalf("SetMeta: %v\n", err)
+	}
+	err = fs.SetMeta("/moe-moe.txt", CacheControl, "max-age=3600")
+	if err != nil {
+		t.Fatalf("SetMeta: %v\n", err)
+	}
+
+	meta, err := fs.Meta("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("Meta: %v\n", err)
+	}
+	if meta[ContentType] != "text/plain; charset=utf-8" {
+		t.Errorf("content type = '%s'\n", meta[ContentType])
+	}
+	if meta[CacheControl] != "max-age=3600" {
+		t.Errorf("cache control = '%s'\n", meta[CacheControl])
+	}
+
+	// Ownership is unchanged.
+	uid, gid, err := usergroup(conn, "/moe-moe.txt", "adm")
+	if err != nil {
+		t.Fatalf("usergroup: %v\n", err)
+	}
+	if uid != "moe" || gid != "moe" {
+		t.Errorf("owner changed to %s:%s\n", uid, gid)
+	}
+
+	// A gateway can read the metadata over 9P.
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/"+uidgidFile, plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	data, err := ioutil.ReadAll(fid)
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if !strings.Contains(string(data), "moe-moe.txt:3:3:cache=max-age=3600:type=text/plain; charset=utf-8\n") {
+		t.Errorf("%s = '%s'\n", uidgidFile, data)
+	}
+
+	// Clearing a value removes it; reserved and malformed keys are rejected.
+	err = fs.SetMeta("/moe-moe.txt", CacheControl, "")
+	if err != nil {
+		t.Fatalf("SetMeta: %v\n", err)
+	}
+	meta, err = fs.Meta("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("Meta: %v\n", err)
+	}
+	if _, ok := meta[CacheControl]; ok {
+		t.Error("cache control not cleared")
+	}
+	if fs.SetMeta("/moe-moe.txt", "mode", "0") == nil {
+		t.Error("set reserved key mode")
+	}
+	if fs.SetMeta("/moe-moe.txt", ContentType, "a:b") == nil {
+		t.Error("set value containing ':'")
+	}
+}
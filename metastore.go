@@ -0,0 +1,293 @@
+package vufs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Ownership and other metadata for a file that is not kept by the
+// file system on disk.
+type FileMeta struct {
+	Uid  string // owner name
+	Gid  string // group name
+	Muid string // name of the user who last modified the file
+
+	// 9P mode bits with no on-disk equivalent (DMAPPEND, DMEXCL).
+	Mode uint32
+
+	// Other key=value metadata, for example ContentType.
+	Attrs map[string]string
+}
+
+// A MetaStore keeps the FileMeta for each file.  Paths are full
+// paths on disk, e.g. './tmpfs/test.txt'.  VuFs serializes calls
+// that change the store.
+type MetaStore interface {
+	// Get returns the metadata for path; ok is false if there is none.
+	Get(path string) (m FileMeta, ok bool, err error)
+
+	// Set replaces the metadata for path.
+	Set(path string, m FileMeta) error
+
+	// Delete removes the metadata for path, if any.
+	Delete(path string) error
+}
+
+// The default MetaStore: each directory has a .uidgid file with a
+// line per file of the form
+//
+//	name:uid:gid[:key=value...]
+//
+// where uid and gid are user ids from the users file.  The mode key
+// holds FileMeta.Mode in hex and the muid key the id of the last
+// modifier (when it is not the owner); other keys are FileMeta.Attrs.
+//
+// .uidgid files are replaced whole, so a crash leaves the old or
+// the new one.  A file whose line cannot be parsed is treated as
+// having none, with a warning to logger (or standard error).
+type sidecarStore struct {
+	upool  p.Users
+	logger Logger
+}
+
+// Return the store for file metadata.
+func (u *VuFs) store() MetaStore {
+	var store MetaStore = sidecarStore{u.Upool, u.Logger}
+	if u.Store != nil {
+		store = u.Store
+	}
+	if u.Owner != "" {
+		store = ownedStore{store, u.Owner}
+	}
+	return store
+}
+
+// A MetaStore whose files with no metadata are owned by owner,
+// group owner.  Get still reports that there is none.
+type ownedStore struct {
+	MetaStore
+	owner string
+}
+
+func (s ownedStore) Get(path string) (FileMeta, bool, error) {
+	m, ok, err := s.MetaStore.Get(path)
+	if err == nil && !ok {
+		m = FileMeta{Uid: s.owner, Gid: s.owner}
+	}
+	return m, ok, err
+}
+
+// Return the metadata for path.  Files with no metadata are owned
+// by adm, group adm, unless the store gives another owner.
+func getMeta(store MetaStore, path string) (FileMeta, error) {
+	m, ok, err := store.Get(path)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	if !ok && m.Uid == "" {
+		m = FileMeta{Uid: "adm", Gid: "adm"}
+	}
+	if m.Muid == "" {
+		m.Muid = m.Uid
+	}
+	return m, nil
+}
+
+func (s sidecarStore) Get(path string) (FileMeta, bool, error) {
+
+	var m FileMeta
+
+	dn := filepath.Dir(path)
+	fn := filepath.Base(path)
+
+	data, err := ioutil.ReadFile(filepath.Join(dn, uidgidFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, false, nil
+		}
+		return m, false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+
+		if line == "#" {
+			continue
+		}
+
+		columns := strings.Split(line, ":")
+		if columns[0] != fn {
+			continue
+		}
+		if len(columns) < 3 {
+			s.warnf(dn, line, fmt.Errorf("too few fields"))
+			return FileMeta{}, false, nil
+		}
+
+		m.Uid, err = uid2name(columns[1], s.upool)
+		if err != nil {
+			s.warnf(dn, line, err)
+			return FileMeta{}, false, nil
+		}
+
+		m.Gid, err = uid2name(columns[2], s.upool)
+		if err != nil {
+			s.warnf(dn, line, err)
+			return FileMeta{}, false, nil
+		}
+
+		m.Attrs = parseAttrs(columns[3:])
+		if v, ok := m.Attrs["mode"]; ok {
+			bits, err := strconv.ParseUint(v, 16, 32)
+			if err == nil {
+				m.Mode = uint32(bits) & metaModeBits
+			}
+			delete(m.Attrs, "mode")
+		}
+		if v, ok := m.Attrs["muid"]; ok {
+			m.Muid, err = uid2name(v, s.upool)
+			if err != nil {
+				s.warnf(dn, line, err)
+				return FileMeta{}, false, nil
+			}
+			delete(m.Attrs, "muid")
+		}
+
+		return m, true, nil
+	}
+
+	return m, false, nil
+}
+
+func (s sidecarStore) Set(path string, m FileMeta) error {
+
+	uid := s.upool.Uname2User(m.Uid)
+	if uid == nil {
+		return fmt.Errorf("no user named '%s'", m.Uid)
+	}
+	gid := s.upool.Uname2User(m.Gid)
+	if gid == nil {
+		return fmt.Errorf("no user named '%s'", m.Gid)
+	}
+
+	attrs := make(map[string]string, len(m.Attrs)+2)
+	for k, v := range m.Attrs {
+		attrs[k] = v
+	}
+	if bits := m.Mode & metaModeBits; bits != 0 {
+		attrs["mode"] = strconv.FormatUint(uint64(bits), 16)
+	}
+	if m.Muid != "" && m.Muid != m.Uid {
+		muid := s.upool.Uname2User(m.Muid)
+		if muid == nil {
+			return fmt.Errorf("no user named '%s'", m.Muid)
+		}
+		attrs["muid"] = strconv.Itoa(muid.Id())
+	}
+
+	return setUidGid(filepath.Dir(path), filepath.Base(path), uid.Id(), gid.Id(), attrs)
+}
+
+func (s sidecarStore) Delete(path string) error {
+
+	fn := filepath.Join(filepath.Dir(path), uidgidFile)
+	file := filepath.Base(path)
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		columns := strings.Split(line, ":")
+		if len(columns) >= 3 && columns[0] == file {
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	return writeFileAtomic(fn, []byte(strings.Join(kept, "\n")), 0600)
+}
+
+// Replace (or add) a file's line in the .uidgid file in dir.
+func setUidGid(dir, file string, uid, gid int, attrs map[string]string) error {
+
+	fn := filepath.Join(dir, uidgidFile)
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	newline := fmt.Sprintf("%s:%d:%d%s", file, uid, gid, formatAttrs(attrs))
+
+	var lines []string
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		columns := strings.Split(line, ":")
+		if len(columns) >= 3 && columns[0] == file {
+			if !found {
+				lines = append(lines, newline)
+			}
+			found = true
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if !found {
+		lines = append(lines, newline)
+	}
+
+	return writeFileAtomic(fn, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// Warn that a line of the .uidgid file in dir is bad.
+func (s sidecarStore) warnf(dir, line string, err error) {
+	logger := s.logger
+	if logger == nil {
+		logger = stderrLogger
+	}
+	logger.Printf("%s: ignoring bad line %q: %v", filepath.Join(dir, uidgidFile), line, err)
+}
+
+// Parse the key=value columns of a .uidgid line.
+func parseAttrs(columns []string) map[string]string {
+	if len(columns) == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, len(columns))
+	for _, c := range columns {
+		if i := strings.Index(c, "="); i > 0 {
+			attrs[c[:i]] = c[i+1:]
+		}
+	}
+	return attrs
+}
+
+// Format attributes as the trailing columns of a .uidgid line.
+func formatAttrs(attrs map[string]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var s string
+	for _, k := range keys {
+		s += ":" + k + "=" + attrs[k]
+	}
+	return s
+}
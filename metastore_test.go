@@ -0,0 +1,332 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"9fans.net/go/plan9"
+	"github.com/lionkov/go9p/p"
+)
+
+// A MetaStore that keeps metadata in memory.
+type memStore struct {
+	mu   sync.Mutex
+	meta map[string]FileMeta
+}
+
+func newMemStore() *memStore {
+	return &memStore{meta: make(map[string]FileMeta)}
+}
+
+func (s *memStore) Get(path string) (FileMeta, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.meta[filepath.Clean(path)]
+	return m, ok, nil
+}
+
+func (s *memStore) Set(path string, m FileMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meta[filepath.Clean(path)] = m
+	return nil
+}
+
+func (s *memStore) Delete(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.meta, filepath.Clean(path))
+	return nil
+}
+
+func TestMetaStore(t *testing.T) {
+
+	store := newMemStore()
+	conn := runserverWith(rootdir, port, func(v *VuFs) { v.Store = store })
+
+	sidecar, err := ioutil.ReadFile(filepath.Join(rootdir, uidgidFile))
+	if err != nil {
+		t.Fatalf("read %s: %v\n", uidgidFile, err)
+	}
+
+	err = create(conn, "adm", "/pub", os.ModeDir+0777)
+	if err != nil {
+		t.Fatalf("adm create /pub: %v\n", err)
+	}
+	// Undo the umask.
+	err = os.Chmod(filepath.Join(rootdir, "pub"), 0777)
+	if err != nil {
+		t.Fatalf("chmod /pub: %v\n", err)
+	}
+	err = create(conn, "moe", "/pub/m", 0644)
+	if err != nil {
+		t.Fatalf("moe create /pub/m: %v\n", err)
+	}
+
+	// A new file is owned by its creator and takes the directory's group.
+	uid, gid, err := usergroup(conn, "/pub/m", "moe")
+	if err != nil {
+		t.Fatalf("usergroup: %v\n", err)
+	}
+	if uid != "moe" || gid != "adm" {
+		t.Errorf("/pub/m is %s:%s, expected moe:adm\n", uid, gid)
+	}
+	m, ok, _ := store.Get(filepath.Join(rootdir, "pub", "m"))
+	if !ok || m.Uid != "moe" || m.Gid != "adm" || m.Muid != "moe" {
+		t.Errorf("store has %+v for /pub/m\n", m)
+	}
+
+	// Mode bits with no on-disk equivalent are kept in the store.
+	err = create(conn, "moe", "/pub/log", os.ModeAppend+0644)
+	if err != nil {
+		t.Fatalf("create /pub/log: %v\n", err)
+	}
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	d, err := fsys.Stat("/pub/log")
+	if err != nil {
+		t.Fatalf("stat /pub/log: %v\n", err)
+	}
+	if d.Mode&plan9.DMAPPEND == 0 {
+		t.Errorf("/pub/log mode = %v, expected DMAPPEND\n", d.Mode)
+	}
+
+	// Renaming moves the metadata.
+	nd := new(plan9.Dir)
+	nd.Null()
+	nd.Name = "n"
+	err = fsys.Wstat("/pub/m", nd)
+	if err != nil {
+		t.Fatalf("rename /pub/m: %v\n", err)
+	}
+	if _, ok, _ := store.Get(filepath.Join(rootdir, "pub", "m")); ok {
+		t.Error("store still has /pub/m after rename")
+	}
+	uid, gid, err = usergroup(conn, "/pub/n", "moe")
+	if err != nil {
+		t.Fatalf("usergroup: %v\n", err)
+	}
+	if uid != "moe" || gid != "adm" {
+		t.Errorf("/pub/n is %s:%s, expected moe:adm\n", uid, gid)
+	}
+
+	// Removing deletes it.
+	err = remove(conn, "moe", "/pub/n")
+	if err != nil {
+		t.Fatalf("remove /pub/n: %v\n", err)
+	}
+	if _, ok, _ := store.Get(filepath.Join(rootdir, "pub", "n")); ok {
+		t.Error("store still has /pub/n after remove")
+	}
+
+	// The sidecar files are not used.
+	data, err := ioutil.ReadFile(filepath.Join(rootdir, uidgidFile))
+	if err != nil {
+		t.Fatalf("read %s: %v\n", uidgidFile, err)
+	}
+	if string(data) != string(sidecar) {
+		t.Errorf("%s changed to '%s'\n", uidgidFile, data)
+	}
+	_, err = ioutil.ReadFile(filepath.Join(rootdir, "pub", uidgidFile))
+	if err == nil {
+		t.Errorf("/pub/%s was written\n", uidgidFile)
+	}
+}
+
+func TestBadSidecar(t *testing.T) {
+
+	fs := newfs(rootdir)
+	var buf syncBuffer
+	fs.Logger = log.New(&buf, "", 0)
+
+	// As if a write of the .uidgid file had been cut short.
+	fn := filepath.Join(rootdir, "t.txt")
+	err := ioutil.WriteFile(fn, []byte("t"), 0644)
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(rootdir, uidgidFile), []byte("t.txt:3:"), 0600)
+	if err != nil {
+		t.Fatalf("write %s: %v\n", uidgidFile, err)
+	}
+
+	s := fs.Connect("adm")
+	fid, err := s.Walk("/t.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(fid)
+	d, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Uid != "adm" || d.Gid != "adm" {
+		t.Errorf("/t.txt is %s:%s, expected adm:adm\n", d.Uid, d.Gid)
+	}
+	if !strings.Contains(buf.String(), "t.txt:3:") {
+		t.Errorf("no warning logged, got '%s'\n", buf.String())
+	}
+
+	// Setting the owner replaces the bad line, leaving no
+	// temporary file behind.
+	err = fs.store().Set(fn, FileMeta{Uid: "moe", Gid: "moe"})
+	if err != nil {
+		t.Fatalf("set owner: %v\n", err)
+	}
+	d, err = s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Uid != "moe" || d.Gid != "moe" {
+		t.Errorf("/t.txt is %s:%s, expected moe:moe\n", d.Uid, d.Gid)
+	}
+	names, err := filepath.Glob(filepath.Join(rootdir, "*.tmp*"))
+	if err != nil || len(names) != 0 {
+		t.Errorf("temporary files left: %v %v\n", names, err)
+	}
+}
+
+func TestMetaRestart(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	// adm makes an append-only file that moe then writes.
+	adm := fs.Connect("adm")
+	fid, err := adm.Walk("/")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	_, err = adm.Create(fid, "log", p.DMAPPEND|0666, p.OWRITE)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	adm.Clunk(fid)
+	// Undo the umask.
+	err = os.Chmod(filepath.Join(rootdir, "log"), 0666)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+
+	moe := fs.Connect("moe")
+	fid, err = moe.Walk("/log")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	if _, err = moe.Open(fid, p.OWRITE); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	if _, err = moe.Write(fid, []byte("entry\n"), 0); err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+
+	// A write by adm in between doesn't keep moe's next one from
+	// making moe the muid again.
+	afid, err := adm.Walk("/log")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	if _, err = adm.Open(afid, p.OWRITE); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	if _, err = adm.Write(afid, []byte("entry\n"), 0); err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	adm.Clunk(afid)
+	if _, err = moe.Write(fid, []byte("entry\n"), 0); err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	moe.Clunk(fid)
+
+	// A new server on the same tree sees what the old one set.
+	users, err := NewVusers(rootdir, "")
+	if err != nil {
+		t.Fatalf("NewVusers: %v\n", err)
+	}
+	s := New(rootdir, WithUsers(users)).Connect("adm")
+	fid, err = s.Walk("/log")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(fid)
+	d, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	st, err := os.Stat(filepath.Join(rootdir, "log"))
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Uid != "adm" || d.Gid != "adm" || d.Muid != "moe" {
+		t.Errorf("/log is %s:%s muid %s, expected adm:adm muid moe\n", d.Uid, d.Gid, d.Muid)
+	}
+	if d.Mode != p.DMAPPEND|0666 {
+		t.Errorf("/log mode %#o, expected %#o\n", d.Mode, p.DMAPPEND|0666)
+	}
+	if d.Mtime != uint32(st.ModTime().Unix()) || d.Length != 18 {
+		t.Errorf("/log mtime %d length %d, expected %d 18\n", d.Mtime, d.Length, st.ModTime().Unix())
+	}
+}
+
+func TestSetuid(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	adm := fs.Connect("adm")
+	for _, tt := range []struct {
+		name string
+		perm uint32
+	}{
+		{"setuid", p.DMSETUID | 0755},
+		{"setgid", p.DMSETGID | 0755},
+	} {
+		fid, err := adm.Walk("/")
+		if err != nil {
+			t.Fatalf("walk: %v\n", err)
+		}
+		_, err = adm.Create(fid, tt.name, tt.perm, p.OWRITE)
+		adm.Clunk(fid)
+		if err != nil {
+			t.Fatalf("create %s: %v\n", tt.name, err)
+		}
+		// Undo the umask.
+		err = os.Chmod(filepath.Join(rootdir, tt.name), 0755)
+		if err != nil {
+			t.Fatalf("chmod: %v\n", err)
+		}
+
+		// The bit is served by this server and the next, but
+		// the file on disk does not have it.
+		users, err := NewVusers(rootdir, "")
+		if err != nil {
+			t.Fatalf("NewVusers: %v\n", err)
+		}
+		for _, s := range []*Session{adm, New(rootdir, WithUsers(users)).Connect("adm")} {
+			fid, err = s.Walk(tt.name)
+			if err != nil {
+				t.Fatalf("walk: %v\n", err)
+			}
+			d, err := s.Stat(fid)
+			s.Clunk(fid)
+			if err != nil {
+				t.Fatalf("stat: %v\n", err)
+			}
+			if d.Mode != tt.perm {
+				t.Errorf("%s mode %#o, expected %#o\n", tt.name, d.Mode, tt.perm)
+			}
+		}
+		st, err := os.Stat(filepath.Join(rootdir, tt.name))
+		if err != nil {
+			t.Fatalf("stat: %v\n", err)
+		}
+		if st.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			t.Errorf("%s is %v on disk\n", tt.name, st.Mode())
+		}
+	}
+}
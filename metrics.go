@@ -0,0 +1,75 @@
+package vufs
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Counts published with expvar under "vufs", for all servers in the
+// process:
+//
+//	attaches, walks, opens, reads, writes, creates, removes
+//		requests of each kind
+//	errors	requests answered with an error
+//	bytesRead, bytesWritten	data returned by reads and taken by writes
+//	connections	connections open now
+//	fids	fids in use now
+//	users	for each user name, the bytesRead and bytesWritten
+//		by that user's requests
+var metrics = expvar.NewMap("vufs")
+
+// The "users" map, and what guards adding a user to it.
+var (
+	userMetrics   = new(expvar.Map).Init()
+	userMetricsMu sync.Mutex
+)
+
+func init() {
+	metrics.Set("users", userMetrics)
+}
+
+// The counter for each kind of request.
+var opMetrics = map[uint8]string{
+	p.Tattach: "attaches",
+	p.Twalk:   "walks",
+	p.Topen:   "opens",
+	p.Tread:   "reads",
+	p.Twrite:  "writes",
+	p.Tcreate: "creates",
+	p.Tremove: "removes",
+}
+
+// Count the reply rc to a request of type t made by the named user.
+func countReply(t uint8, rc *p.Fcall, uname string) {
+	if name, ok := opMetrics[t]; ok {
+		metrics.Add(name, 1)
+	}
+	if rc == nil {
+		return
+	}
+	switch rc.Type {
+	case p.Rerror:
+		metrics.Add("errors", 1)
+	case p.Rread:
+		metrics.Add("bytesRead", int64(len(rc.Data)))
+		userMetric(uname).Add("bytesRead", int64(len(rc.Data)))
+	case p.Rwrite:
+		metrics.Add("bytesWritten", int64(rc.Count))
+		userMetric(uname).Add("bytesWritten", int64(rc.Count))
+	}
+}
+
+// Return the counts for the named user, adding them if need be.
+func userMetric(uname string) *expvar.Map {
+	userMetricsMu.Lock()
+	defer userMetricsMu.Unlock()
+
+	m, ok := userMetrics.Get(uname).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		userMetrics.Set(uname, m)
+	}
+	return m
+}
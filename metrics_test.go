@@ -0,0 +1,158 @@
+package vufs
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Return the value of the named metric.
+func metric(name string) int64 {
+	v, ok := expvar.Get("vufs").(*expvar.Map).Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// Return the value of the named metric once it stops changing, as
+// it may while the connections of earlier tests are torn down.
+func settledMetric(name string) int64 {
+	n := metric(name)
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		m := metric(name)
+		if m == n {
+			break
+		}
+		n = m
+	}
+	return n
+}
+
+func TestMetrics(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	names := []string{"attaches", "walks", "opens", "reads", "errors", "bytesRead"}
+	before := make(map[string]int64)
+	for _, name := range names {
+		before[name] = metric(name)
+	}
+	if metric("connections") < 1 {
+		t.Errorf("connections = %d, expected at least 1\n", metric("connections"))
+	}
+	fids := settledMetric("fids")
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/moe-moe.txt", p.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	_, err = fid.Read(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	_, err = fsys.Open("/nosuchfile", p.OREAD)
+	if err == nil {
+		t.Fatal("opened /nosuchfile\n")
+	}
+
+	for _, tt := range []struct {
+		name string
+		n    int64
+	}{
+		{"attaches", 1},
+		{"walks", 2},
+		{"opens", 1},
+		{"reads", 1},
+		{"errors", 1},
+		{"bytesRead", int64(len(initialFiles["/moe-moe.txt"].contents))},
+	} {
+		if n := metric(tt.name) - before[tt.name]; n != tt.n {
+			t.Errorf("%s went up by %d, expected %d\n", tt.name, n, tt.n)
+		}
+	}
+
+	// Two fids are left: the root and the open file.
+	if n := metric("fids") - fids; n != 2 {
+		t.Errorf("fids went up by %d, expected 2\n", n)
+	}
+
+	// go9p destroys a fid after replying to the clunk.
+	fid.Close()
+	for i := 0; i < 50 && metric("fids")-fids != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := metric("fids") - fids; n != 1 {
+		t.Errorf("fids went up by %d after clunk, expected 1\n", n)
+	}
+}
+
+// Return the value of the named metric for a user.
+func userMetricValue(uname, name string) int64 {
+	users := expvar.Get("vufs").(*expvar.Map).Get("users").(*expvar.Map)
+	m, ok := users.Get(uname).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	v, ok := m.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestUserMetrics(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	type counts struct{ read, written int64 }
+	get := func(uname string) counts {
+		return counts{userMetricValue(uname, "bytesRead"), userMetricValue(uname, "bytesWritten")}
+	}
+	moe, larry := get("moe"), get("larry")
+
+	// moe writes a file that larry reads.
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/moe-moe.txt", p.OWRITE|p.OTRUNC)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	_, err = fid.Write([]byte("hello"))
+	fid.Close()
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	data, err := read(conn, "larry", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if data != "hello" {
+		t.Fatalf("read '%s', expected 'hello'\n", data)
+	}
+
+	for _, tt := range []struct {
+		uname  string
+		before counts
+		delta  counts
+	}{
+		{"moe", moe, counts{0, 5}},
+		{"larry", larry, counts{5, 0}},
+	} {
+		now := get(tt.uname)
+		delta := counts{now.read - tt.before.read, now.written - tt.before.written}
+		if delta != tt.delta {
+			t.Errorf("%s read %d and wrote %d bytes, expected %d and %d\n",
+				tt.uname, delta.read, delta.written, tt.delta.read, tt.delta.written)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Move the file or directory src to dst on behalf of the named user.
+// Unlike a wstat of the name, dst may be in another directory.  Paths
+// are relative to the file system root and found as a walk would
+// find them.  The user needs write
+// permission on the directories src is moved from and to; dst must
+// not exist.  The file keeps its owner, group and metadata.  Fids
+// that refer to src are left referring to a file that is gone.
+// Move fails with Erofs if the file system is read-only.
+func (u *VuFs) Move(uname, src, dst string) error {
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	if u.isReadOnly() {
+		return Erofs
+	}
+
+	user := u.Upool.Uname2User(uname)
+	if user == nil {
+		return ErrNoUser
+	}
+
+	src = filepath.Join("/", src)
+	dst = filepath.Join("/", dst)
+	if src == "/" || dst == "/" {
+		return srv.Ebaduse
+	}
+
+	err := validFilename(filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+
+	srcfn, ctl, err := u.resolve(user, src)
+	if err != nil {
+		return err
+	}
+	dir, dirctl, err := u.resolve(user, filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if ctl != ctlNone || dirctl != ctlNone {
+		return ErrPerm
+	}
+	dstfn := dir + "/" + filepath.Base(dst)
+
+	_, err = os.Lstat(dstfn)
+	if err == nil {
+		return ErrExist
+	}
+	if !os.IsNotExist(err) {
+		return osError(err)
+	}
+
+	// The user must be able to write to both directories.
+	for _, fn := range []string{srcfn, dstfn} {
+		err = u.checkParentWrite(fn, user)
+		if err != nil {
+			return err
+		}
+	}
+	err = u.checkUsersFile(srcfn, user)
+	if err != nil {
+		return err
+	}
+
+	// Moving would change whether the file is served decompressed.
+	if u.gzipped(srcfn) != u.gzipped(dstfn) {
+		return Ecompressed
+	}
+
+	err = os.Rename(srcfn, dstfn)
+	if err != nil {
+		return osError(err)
+	}
+
+	// The metadata moves with the file.
+	store := u.store()
+	m, ok, err := store.Get(srcfn)
+	if err == nil && ok {
+		err = store.Set(dstfn, m)
+		if err == nil {
+			err = store.Delete(srcfn)
+		}
+	}
+	if err != nil {
+		os.Rename(dstfn, srcfn)
+		store.Delete(dstfn)
+		return osError(err)
+	}
+
+	return nil
+}
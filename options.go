@@ -0,0 +1,66 @@
+package vufs
+
+import (
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// An Option sets up a VuFs made by New.
+type Option func(*VuFs)
+
+// Send the server's messages to l.
+func WithLogger(l Logger) Option {
+	return func(u *VuFs) { u.Logger = l }
+}
+
+// Make the named user the owner of the root and of files with no
+// owner recorded (see Owner, and the vufs command's -user).
+func WithDefaultUser(uname string) Option {
+	return func(u *VuFs) { u.Owner = uname }
+}
+
+// Run attaches by unknown users as the named user (see Guest, and
+// the vufs command's -guest).
+func WithGuest(uname string) Option {
+	return func(u *VuFs) { u.Guest = uname }
+}
+
+// Take users and groups from users, usually made by NewVusers.
+func WithUsers(users p.Users) Option {
+	return func(u *VuFs) { u.Upool = users }
+}
+
+// Offer clients at most msize bytes per message.  It is lowered to
+// maxMsize if larger.
+func WithMaxMsize(msize uint32) Option {
+	return func(u *VuFs) { u.Msize = msize }
+}
+
+// Serve the tree read-only (see SetReadOnly).
+func WithReadOnly() Option {
+	return func(u *VuFs) { u.readOnly = true }
+}
+
+// Close connections whose client takes longer than d to read a
+// reply (see WriteTimeout).
+func WithWriteTimeout(d time.Duration) Option {
+	return func(u *VuFs) { u.WriteTimeout = d }
+}
+
+// Probe idle TCP connections every d to find clients that are
+// gone (see KeepAlive).
+func WithKeepAlive(d time.Duration) Option {
+	return func(u *VuFs) { u.KeepAlive = d }
+}
+
+// Allow each connection at most n fids (see MaxFids).
+func WithMaxFids(n int) Option {
+	return func(u *VuFs) { u.MaxFids = n }
+}
+
+// Let walks follow symbolic links that stay inside the tree (see
+// FollowSymlinks).
+func WithFollowSymlinks() Option {
+	return func(u *VuFs) { u.FollowSymlinks = true }
+}
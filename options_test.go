@@ -0,0 +1,121 @@
+package vufs
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+
+	// With no options, nothing is set.
+	fs := New(rootdir)
+	if fs.Root != rootdir || fs.Logger != nil || fs.Guest != "" || fs.Owner != "" || fs.Upool != nil || fs.Msize != 0 {
+		t.Errorf("New with no options: %+v\n", fs)
+	}
+
+	newfs(rootdir)
+	users, err := NewVusers(rootdir, "")
+	if err != nil {
+		t.Fatalf("NewVusers: %v\n", err)
+	}
+	logger := log.New(new(syncBuffer), "", 0)
+
+	fs = New(rootdir,
+		WithLogger(logger),
+		WithGuest("larry"),
+		WithDefaultUser("moe"),
+		WithUsers(users),
+		WithMaxMsize(4096))
+	if fs.Logger != logger {
+		t.Errorf("Logger is %v, expected %v\n", fs.Logger, logger)
+	}
+	if fs.Guest != "larry" {
+		t.Errorf("Guest is '%s', expected 'larry'\n", fs.Guest)
+	}
+	if fs.Owner != "moe" {
+		t.Errorf("Owner is '%s', expected 'moe'\n", fs.Owner)
+	}
+	if fs.Upool != users {
+		t.Errorf("Upool is %v, expected %v\n", fs.Upool, users)
+	}
+	if fs.readOnly {
+		t.Error("read-only without WithReadOnly")
+	}
+	if !New(rootdir, WithReadOnly()).readOnly {
+		t.Error("WithReadOnly did not make the file system read-only")
+	}
+	if d := New(rootdir, WithWriteTimeout(time.Second)).WriteTimeout; d != time.Second {
+		t.Errorf("WriteTimeout is %v, expected 1s\n", d)
+	}
+	if d := New(rootdir, WithKeepAlive(time.Minute)).KeepAlive; d != time.Minute {
+		t.Errorf("KeepAlive is %v, expected 1m\n", d)
+	}
+	if n := New(rootdir, WithMaxFids(10)).MaxFids; n != 10 {
+		t.Errorf("MaxFids is %d, expected 10\n", n)
+	}
+	if fs.FollowSymlinks || !New(rootdir, WithFollowSymlinks()).FollowSymlinks {
+		t.Error("WithFollowSymlinks did not set FollowSymlinks")
+	}
+
+	// The guest is used for unknown users.
+	fid, err := fs.Connect("nobody").Walk("/")
+	if err != nil {
+		t.Fatalf("walk as nobody: %v\n", err)
+	}
+	fs.Connect("nobody").Clunk(fid)
+
+	// Clients asking for a larger msize get the maximum.
+	runserverWith(rootdir, port, WithMaxMsize(4096))
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+	if c.msize != 4096 {
+		t.Errorf("msize %d, expected 4096\n", c.msize)
+	}
+}
+
+func TestOwner(t *testing.T) {
+
+	newfs(rootdir)
+	users, err := NewVusers(rootdir, "")
+	if err != nil {
+		t.Fatalf("NewVusers: %v\n", err)
+	}
+	fs := New(rootdir, WithUsers(users), WithDefaultUser("larry"))
+	if err = fs.Ping(); err != nil {
+		t.Errorf("Ping: %v\n", err)
+	}
+
+	// The root has no owner recorded; moe-moe.txt does.
+	s := fs.Connect("adm")
+	for _, tt := range []struct {
+		path, uid, gid string
+	}{
+		{"/", "larry", "larry"},
+		{"/moe-moe.txt", "moe", "moe"},
+	} {
+		fid, err := s.Walk(tt.path)
+		if err != nil {
+			t.Fatalf("walk %s: %v\n", tt.path, err)
+		}
+		d, err := s.Stat(fid)
+		s.Clunk(fid)
+		if err != nil {
+			t.Fatalf("stat %s: %v\n", tt.path, err)
+		}
+		if d.Uid != tt.uid || d.Gid != tt.gid {
+			t.Errorf("%s is %s:%s, expected %s:%s\n", tt.path, d.Uid, d.Gid, tt.uid, tt.gid)
+		}
+	}
+
+	// The default user must be a user, as must the guest.
+	if err = New(rootdir, WithUsers(users), WithDefaultUser("nobody")).Ping(); err == nil {
+		t.Error("Ping succeeded with an unknown default user\n")
+	}
+	if err = New(rootdir, WithUsers(users), WithGuest("nobody")).Ping(); err == nil {
+		t.Error("Ping succeeded with an unknown guest\n")
+	}
+}
@@ -0,0 +1,82 @@
+//go:build prometheus
+// +build prometheus
+
+package vufs
+
+import (
+	"expvar"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Collector reports the counts in metrics to Prometheus.  It is
+// built only with the prometheus build tag, so that the package
+// does not otherwise depend on the Prometheus client.
+type Collector struct{}
+
+var (
+	requestsDesc = prometheus.NewDesc("vufs_requests_total",
+		"Requests answered, by kind.", []string{"op"}, nil)
+	errorsDesc = prometheus.NewDesc("vufs_errors_total",
+		"Requests answered with an error.", nil, nil)
+	connectionsDesc = prometheus.NewDesc("vufs_connections",
+		"Connections open now.", nil, nil)
+	fidsDesc = prometheus.NewDesc("vufs_fids",
+		"Fids in use now.", nil, nil)
+	readBytesDesc = prometheus.NewDesc("vufs_read_bytes_total",
+		"Bytes of data returned by reads.", nil, nil)
+	writtenBytesDesc = prometheus.NewDesc("vufs_written_bytes_total",
+		"Bytes of data taken by writes.", nil, nil)
+	userReadBytesDesc = prometheus.NewDesc("vufs_user_read_bytes_total",
+		"Bytes of data returned by reads, by user.", []string{"user"}, nil)
+	userWrittenBytesDesc = prometheus.NewDesc("vufs_user_written_bytes_total",
+		"Bytes of data taken by writes, by user.", []string{"user"}, nil)
+)
+
+func (Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- requestsDesc
+	ch <- errorsDesc
+	ch <- connectionsDesc
+	ch <- fidsDesc
+	ch <- readBytesDesc
+	ch <- writtenBytesDesc
+	ch <- userReadBytesDesc
+	ch <- userWrittenBytesDesc
+}
+
+func (Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range opMetrics {
+		ch <- prometheus.MustNewConstMetric(requestsDesc,
+			prometheus.CounterValue, metricValue(name), name)
+	}
+	ch <- prometheus.MustNewConstMetric(errorsDesc,
+		prometheus.CounterValue, metricValue("errors"))
+	ch <- prometheus.MustNewConstMetric(connectionsDesc,
+		prometheus.GaugeValue, metricValue("connections"))
+	ch <- prometheus.MustNewConstMetric(fidsDesc,
+		prometheus.GaugeValue, metricValue("fids"))
+	ch <- prometheus.MustNewConstMetric(readBytesDesc,
+		prometheus.CounterValue, metricValue("bytesRead"))
+	ch <- prometheus.MustNewConstMetric(writtenBytesDesc,
+		prometheus.CounterValue, metricValue("bytesWritten"))
+	userMetrics.Do(func(kv expvar.KeyValue) {
+		m := kv.Value.(*expvar.Map)
+		ch <- prometheus.MustNewConstMetric(userReadBytesDesc,
+			prometheus.CounterValue, mapValue(m, "bytesRead"), kv.Key)
+		ch <- prometheus.MustNewConstMetric(userWrittenBytesDesc,
+			prometheus.CounterValue, mapValue(m, "bytesWritten"), kv.Key)
+	})
+}
+
+// Return the named count, or zero if nothing has been counted.
+func metricValue(name string) float64 {
+	return mapValue(metrics, name)
+}
+
+// Return the named count in m, or zero if there is none.
+func mapValue(m *expvar.Map, name string) float64 {
+	if v, ok := m.Get(name).(*expvar.Int); ok {
+		return float64(v.Value())
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+//go:build prometheus
+// +build prometheus
+
+package vufs
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+	_, err := read(conn, "adm", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	err = reg.Register(Collector{})
+	if err != nil {
+		t.Fatalf("Register: %v\n", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v\n", err)
+	}
+
+	found := false
+	for _, f := range families {
+		if f.GetName() != "vufs_requests_total" {
+			continue
+		}
+		found = true
+		for _, m := range f.GetMetric() {
+			op := m.GetLabel()[0].GetValue()
+			if op == "reads" && m.GetCounter().GetValue() < 1 {
+				t.Errorf("reads = %v, expected at least 1\n", m.GetCounter().GetValue())
+			}
+		}
+	}
+	if !found {
+		t.Error("no vufs_requests_total family\n")
+	}
+}
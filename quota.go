@@ -0,0 +1,140 @@
+package vufs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// Returned when a write or create would take a user past their quota.
+var Equota = &p.Error{"quota exceeded", uint32(syscall.EDQUOT)}
+
+// Report whether the user named uid has a quota.
+func (u *VuFs) hasQuota(uid string) bool {
+	_, ok := u.Quota[uid]
+	return ok
+}
+
+// Return the bytes held by the files uid owns.  The tree is
+// scanned the first time; after that, usage is kept up to date as
+// files are written and removed.  The caller holds quotaMu.
+func (u *VuFs) quotaUsed(uid string) (int64, error) {
+	if n, ok := u.used[uid]; ok {
+		return n, nil
+	}
+
+	store := u.store()
+	var n int64
+	err := filepath.Walk(u.Root, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !st.Mode().IsRegular() || st.Name() == uidgidFile {
+			return nil
+		}
+		m, err := getMeta(store, path)
+		if err != nil {
+			return err
+		}
+		if m.Uid == uid {
+			n += st.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, toError(err)
+	}
+
+	if u.used == nil {
+		u.used = make(map[string]int64)
+	}
+	u.used[uid] = n
+	return n, nil
+}
+
+// Bring VuFs up to date after other programs change the tree.
+// Walks, stats and reads always see the files on disk, and a fid is
+// found again by its path on each request, so a fid whose file was
+// removed fails with Eremoved.  What Rescan refreshes is the
+// space each user with a quota is charged for, which is otherwise
+// counted once and then kept up to date only through VuFs.
+func (u *VuFs) Rescan() error {
+	u.tree.Lock()
+	defer u.tree.Unlock()
+	u.quotaMu.Lock()
+	defer u.quotaMu.Unlock()
+
+	u.used = nil
+	for uid := range u.Quota {
+		_, err := u.quotaUsed(uid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add n bytes to what uid's files hold, failing with Equota if that
+// would take uid past its quota.  A negative n frees space and
+// always succeeds.
+func (u *VuFs) chargeQuota(uid string, n int64) error {
+	limit, ok := u.Quota[uid]
+	if !ok || n == 0 {
+		return nil
+	}
+
+	u.quotaMu.Lock()
+	defer u.quotaMu.Unlock()
+
+	used, err := u.quotaUsed(uid)
+	if err != nil {
+		return err
+	}
+	if n > 0 && used+n > limit {
+		return Equota
+	}
+	u.used[uid] = used + n
+	return nil
+}
+
+// Fail with Equota if uid has used all of its quota.
+func (u *VuFs) checkQuota(uid string) error {
+	limit, ok := u.Quota[uid]
+	if !ok {
+		return nil
+	}
+
+	u.quotaMu.Lock()
+	defer u.quotaMu.Unlock()
+
+	used, err := u.quotaUsed(uid)
+	if err != nil {
+		return err
+	}
+	if used >= limit {
+		return Equota
+	}
+	return nil
+}
+
+// Return the owner of the file at path, if the owner has a quota,
+// and the bytes the file holds against it.
+func (u *VuFs) quotaOwner(path string) (string, int64, error) {
+	if len(u.Quota) == 0 {
+		return "", 0, nil
+	}
+	m, err := getMeta(u.store(), path)
+	if err != nil || !u.hasQuota(m.Uid) {
+		return "", 0, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", 0, toError(err)
+	}
+	if !st.Mode().IsRegular() {
+		return m.Uid, 0, nil
+	}
+	return m.Uid, st.Size(), nil
+}
@@ -0,0 +1,164 @@
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+)
+
+func TestQuota(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	dir := filepath.Join(rootdir, "moe")
+	err := os.Mkdir(dir, 0777)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+	// Undo the umask.
+	err = os.Chmod(dir, 0777)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+	err = fs.store().Set(dir, FileMeta{Uid: "moe", Gid: "moe", Muid: "moe"})
+	if err != nil {
+		t.Fatalf("set owner: %v\n", err)
+	}
+
+	// moe already owns some files; allow ten bytes more.
+	used, err := fs.quotaUsed("moe")
+	if err != nil {
+		t.Fatalf("quotaUsed: %v\n", err)
+	}
+	fs.Quota = map[string]int64{"moe": used + 10}
+
+	s := fs.Connect("moe")
+	fid, err := s.Walk("/moe")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	_, err = s.Create(fid, "a", 0644, p.ORDWR)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	if _, err = s.Write(fid, []byte("12345678"), 0); err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	if _, err = s.Write(fid, []byte("9abc"), 8); err != Equota {
+		t.Errorf("write past quota: got %v, expected %v\n", err, Equota)
+	}
+
+	// Overwriting does not use more space.
+	if _, err = s.Write(fid, []byte("87654321"), 0); err != nil {
+		t.Errorf("overwrite: %v\n", err)
+	}
+	if _, err = s.Write(fid, []byte("9a"), 8); err != nil {
+		t.Errorf("write up to quota: %v\n", err)
+	}
+	s.Clunk(fid)
+
+	// With the quota used up, moe cannot create files ...
+	fid, _ = s.Walk("/moe")
+	if _, err = s.Create(fid, "b", 0644, p.OWRITE); err != Equota {
+		t.Errorf("create at quota: got %v, expected %v\n", err, Equota)
+	}
+	s.Clunk(fid)
+
+	// ... but other users can.
+	adm := fs.Connect("adm")
+	fid, _ = adm.Walk("/moe")
+	if _, err = adm.Create(fid, "b", 0666, p.OWRITE); err != nil {
+		t.Errorf("adm create: %v\n", err)
+	}
+	adm.Clunk(fid)
+	os.Chmod(filepath.Join(dir, "b"), 0666)
+
+	// Removing a file frees its space.
+	fid, _ = s.Walk("/moe/a")
+	if err = s.Remove(fid); err != nil {
+		t.Fatalf("remove: %v\n", err)
+	}
+	fid, _ = s.Walk("/moe")
+	if _, err = s.Create(fid, "c", 0644, p.OWRITE); err != nil {
+		t.Fatalf("create after remove: %v\n", err)
+	}
+	if _, err = s.Write(fid, []byte("0123456789"), 0); err != nil {
+		t.Errorf("write after remove: %v\n", err)
+	}
+	s.Clunk(fid)
+
+	// A write to a file moe does not own is charged to its owner.
+	fid, _ = s.Walk("/moe/b")
+	if _, err = s.Open(fid, p.OWRITE); err != nil {
+		t.Fatalf("open /moe/b: %v\n", err)
+	}
+	if _, err = s.Write(fid, []byte("more"), 0); err != nil {
+		t.Errorf("write to adm's file: %v\n", err)
+	}
+	s.Clunk(fid)
+}
+
+func TestRescan(t *testing.T) {
+
+	fs := newfs(rootdir)
+	used, err := fs.quotaUsed("moe")
+	if err != nil {
+		t.Fatalf("quotaUsed: %v\n", err)
+	}
+	fs.Quota = map[string]int64{"moe": used + 10}
+
+	s := fs.Connect("moe")
+	gone, err := s.Walk("/larry-moe.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(gone)
+
+	// Behind the server's back, give moe a new file past the quota
+	// and remove another.
+	fn := filepath.Join(rootdir, "outside.txt")
+	err = ioutil.WriteFile(fn, []byte("0123456789abcdef"), 0644)
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	err = fs.store().Set(fn, FileMeta{Uid: "moe", Gid: "moe", Muid: "moe"})
+	if err != nil {
+		t.Fatalf("set owner: %v\n", err)
+	}
+	if err = fs.checkQuota("moe"); err != nil {
+		t.Fatalf("checkQuota before Rescan: %v\n", err)
+	}
+	err = os.Remove(filepath.Join(rootdir, "larry-moe.txt"))
+	if err != nil {
+		t.Fatalf("remove: %v\n", err)
+	}
+
+	if err = fs.Rescan(); err != nil {
+		t.Fatalf("Rescan: %v\n", err)
+	}
+
+	if err = fs.checkQuota("moe"); err != Equota {
+		t.Errorf("checkQuota after Rescan: got %v, expected %v\n", err, Equota)
+	}
+
+	fid, err := s.Walk("/outside.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(fid)
+	if _, err = s.Open(fid, p.OREAD); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	buf := make([]byte, 100)
+	n, err := s.Read(fid, buf, 0)
+	if err != nil || string(buf[:n]) != "0123456789abcdef" {
+		t.Errorf("read: got %q %v\n", buf[:n], err)
+	}
+
+	if _, err = s.Stat(gone); err != Eremoved {
+		t.Errorf("stat of removed file: got %v, expected %v\n", err, Eremoved)
+	}
+}
@@ -0,0 +1,288 @@
+package vufs
+
+import (
+	"path/filepath"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// A Session uses the file system from the same process, as a user
+// attached to the root.  Like a 9P client, it refers to files by
+// fids, but calls the server directly rather than over a
+// connection.
+type Session struct {
+	u    *VuFs
+	user p.User
+}
+
+// Start a session for the named user, or for Guest if the user is
+// unknown.  If there is no such user, every method of the session
+// returns ErrNoUser.
+func (u *VuFs) Connect(uname string) *Session {
+	user := u.Upool.Uname2User(uname)
+	if user == nil && u.Guest != "" {
+		user = u.Upool.Uname2User(u.Guest)
+	}
+	return &Session{u, user}
+}
+
+// Return a new fid for the file at path, relative to the root.
+func (s *Session) Walk(path string) (*Fid, error) {
+	if s.user == nil {
+		return nil, ErrNoUser
+	}
+
+	s.u.tree.RLock()
+	fpath, ctl, err := s.u.resolve(s.user, path)
+	s.u.tree.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fid{path: fpath, ctl: ctl}, nil
+}
+
+// Open the file fid refers to with a 9P mode such as p.OREAD.
+func (s *Session) Open(fid *Fid, mode uint8) (*p.Qid, error) {
+	if s.user == nil {
+		return nil, ErrNoUser
+	}
+	if fid.opened || fid.clunked {
+		return nil, srv.Ebaduse
+	}
+	if (mode2Perm(mode)&p.DMWRITE != 0 || mode&p.OTRUNC != 0) && fid.isDir() {
+		return nil, Eisdir
+	}
+
+	qid, err := s.u.open(fid, s.user, mode)
+	if err != nil {
+		return nil, err
+	}
+	fid.opened, fid.omode = true, mode
+	return qid, nil
+}
+
+// Create the file name with permissions perm in the directory fid
+// refers to, and open it with mode.  Fid then refers to the new file.
+func (s *Session) Create(fid *Fid, name string, perm uint32, mode uint8) (*p.Qid, error) {
+	if s.user == nil {
+		return nil, ErrNoUser
+	}
+	if fid.opened || fid.clunked {
+		return nil, srv.Ebaduse
+	}
+
+	qid, err := s.u.create(fid, s.user, name, perm, mode)
+	if err != nil {
+		return nil, err
+	}
+	fid.opened, fid.omode = true, mode
+	return qid, nil
+}
+
+// Read into buf from offset in the file open on fid.  Directories
+// are read as packed stats, as in 9P.
+func (s *Session) Read(fid *Fid, buf []byte, offset uint64) (int, error) {
+	if s.user == nil {
+		return 0, ErrNoUser
+	}
+	if !fid.opened || fid.clunked || fid.omode&3 == p.OWRITE {
+		return 0, srv.Ebaduse
+	}
+
+	return s.u.read(fid, s.user, buf, offset, false)
+}
+
+// Write data at offset to the file open on fid.
+func (s *Session) Write(fid *Fid, data []byte, offset uint64) (int, error) {
+	if s.user == nil {
+		return 0, ErrNoUser
+	}
+	if !fid.opened || fid.clunked {
+		return 0, srv.Ebaduse
+	}
+	if fid.omode&3 != p.OWRITE && fid.omode&3 != p.ORDWR {
+		if fid.isDir() {
+			return 0, Eisdir
+		}
+		return 0, srv.Ebaduse
+	}
+
+	return s.u.write(fid, s.user, data, offset)
+}
+
+// Return the stat of the file fid refers to.
+func (s *Session) Stat(fid *Fid) (*p.Dir, error) {
+	if s.user == nil {
+		return nil, ErrNoUser
+	}
+	if fid.clunked {
+		return nil, srv.Eunknownfid
+	}
+
+	return s.u.stat(fid)
+}
+
+// Remove the file fid refers to.  Like Tremove, it clunks fid even
+// if the remove fails.
+func (s *Session) Remove(fid *Fid) error {
+	if s.user == nil {
+		return ErrNoUser
+	}
+	if !s.u.clunkFid(fid) {
+		return srv.Eunknownfid
+	}
+	s.u.destroyFid(fid)
+
+	return s.u.removeFid(fid, s.user)
+}
+
+// Release fid, closing the file if it is open.
+func (s *Session) Clunk(fid *Fid) error {
+	if s.user == nil {
+		return ErrNoUser
+	}
+	err := s.u.clunk(fid, s.user)
+	if err != nil {
+		return err
+	}
+	s.u.destroyFid(fid)
+	return nil
+}
+
+// Create the directory at path, relative to the root, and any
+// missing directories above it, all with permissions perm.  Each is
+// created as Create would, so the user needs write permission on
+// its parent.  Directories that exist are left alone; a file in
+// the way gives Enotdir.
+func (s *Session) MkdirAll(path string, perm uint32) error {
+	if s.user == nil {
+		return ErrNoUser
+	}
+
+	dir := "/"
+	for _, name := range splitPath(path) {
+		next := filepath.Join(dir, name)
+		fid, err := s.Walk(next)
+		if err == ErrNotExist {
+			// Another may create it first; that's fine.
+			err = s.mkdir(dir, name, perm)
+			if err == nil || err == ErrExist {
+				fid, err = s.Walk(next)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		qid, err := s.Qid(fid)
+		s.Clunk(fid)
+		if err != nil {
+			return err
+		}
+		if qid.Type&p.QTDIR == 0 {
+			return Enotdir
+		}
+		dir = next
+	}
+	return nil
+}
+
+// Create the directory name in the directory at path.
+func (s *Session) mkdir(path, name string, perm uint32) error {
+	fid, err := s.Walk(path)
+	if err != nil {
+		return err
+	}
+	_, err = s.Create(fid, name, p.DMDIR|perm, p.OREAD)
+	s.Clunk(fid)
+	return err
+}
+
+// Return the qid of the file fid refers to.  This and the other
+// one-field accessors below are cheaper than Stat: they build no
+// Dir and read only the fields they report.  Length reads no
+// metadata; the others read the file's entry in the MetaStore, and
+// the default one looks up the owner's name in Upool.
+func (s *Session) Qid(fid *Fid) (*p.Qid, error) {
+	f, err := s.probe(fid, true)
+	if err != nil {
+		return nil, err
+	}
+	return &f.qid, nil
+}
+
+// Return the length of the file fid refers to, as Stat would.
+func (s *Session) Length(fid *Fid) (uint64, error) {
+	f, err := s.probe(fid, false)
+	return f.length, err
+}
+
+// Return the 9P mode of the file fid refers to, as Stat would.
+func (s *Session) Mode(fid *Fid) (uint32, error) {
+	f, err := s.probe(fid, true)
+	return f.mode, err
+}
+
+// Return the owner of the file fid refers to.
+func (s *Session) Owner(fid *Fid) (string, error) {
+	f, err := s.probe(fid, true)
+	return f.uid, err
+}
+
+// The fields of a file's stat the accessors report.
+type probed struct {
+	qid    p.Qid
+	mode   uint32
+	length uint64
+	uid    string
+}
+
+// Find the fields of fid's stat that need no Dir, and those that
+// need its metadata if meta is set.
+func (s *Session) probe(fid *Fid, meta bool) (probed, error) {
+	var f probed
+
+	if s.user == nil {
+		return f, ErrNoUser
+	}
+	if fid.clunked {
+		return f, srv.Eunknownfid
+	}
+
+	u := s.u
+	u.tree.RLock()
+	defer u.tree.RUnlock()
+
+	if fid.ctl != ctlNone {
+		d := ctlStat(fid.ctl)
+		return probed{d.Qid, d.Mode, d.Length, d.Uid}, nil
+	}
+
+	st, err := fid.stat()
+	if err != nil {
+		return f, err
+	}
+	f.qid = *dir2Qid(st)
+	f.mode = dir2Npmode(st)
+	if !st.IsDir() {
+		f.length = uint64(st.Size())
+		if u.gzipped(fid.path) {
+			if f.length, err = gzipLength(fid.path); err != nil {
+				return f, toError(err)
+			}
+		}
+	}
+
+	if meta {
+		m, err := getMeta(u.store(), fid.path)
+		if err != nil {
+			return f, toError(err)
+		}
+		f.uid = m.Uid
+		f.mode |= m.Mode & metaModeBits
+		f.qid.Type |= uint8((m.Mode & metaModeBits) >> 24)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,228 @@
+package vufs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+)
+
+func TestSession(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	// Give moe a directory to work in.
+	dir := filepath.Join(rootdir, "moe")
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+	err = fs.store().Set(dir, FileMeta{Uid: "moe", Gid: "moe", Muid: "moe"})
+	if err != nil {
+		t.Fatalf("set owner: %v\n", err)
+	}
+
+	s := fs.Connect("moe")
+	fid, err := s.Walk("/moe")
+	if err != nil {
+		t.Fatalf("walk /moe: %v\n", err)
+	}
+	_, err = s.Create(fid, "notes.txt", 0644, p.OWRITE)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	n, err := s.Write(fid, []byte("hello"), 0)
+	if err != nil || n != 5 {
+		t.Fatalf("write: %d, %v\n", n, err)
+	}
+	if _, err = s.Read(fid, make([]byte, 5), 0); err == nil {
+		t.Error("read from a file open for writing")
+	}
+	if err = s.Clunk(fid); err != nil {
+		t.Fatalf("clunk: %v\n", err)
+	}
+	if err = s.Clunk(fid); err == nil {
+		t.Error("clunked twice")
+	}
+
+	// Errors from the file system are the package's own.
+	fid, err = s.Walk("/moe")
+	if err != nil {
+		t.Fatalf("walk /moe: %v\n", err)
+	}
+	if _, err = s.Create(fid, "notes.txt", 0644, p.OWRITE); !errors.Is(err, ErrExist) {
+		t.Errorf("create an existing file: got %v, expected %v\n", err, ErrExist)
+	}
+	s.Clunk(fid)
+	fid, err = s.Walk("/moe")
+	if err != nil {
+		t.Fatalf("walk /moe: %v\n", err)
+	}
+	if _, err = s.Create(fid, "notes.txt", p.DMDIR|0755, p.OREAD); !errors.Is(err, ErrExist) {
+		t.Errorf("create a directory over a file: got %v, expected %v\n", err, ErrExist)
+	}
+	s.Clunk(fid)
+
+	fid, err = s.Walk("/moe/notes.txt")
+	if err != nil {
+		t.Fatalf("walk /moe/notes.txt: %v\n", err)
+	}
+	d, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Uid != "moe" || d.Length != 5 {
+		t.Errorf("stat: uid %s, length %d, expected moe, 5\n", d.Uid, d.Length)
+	}
+	_, err = s.Open(fid, p.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	buf := make([]byte, 16)
+	n, err = s.Read(fid, buf, 0)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read '%s', %v, expected 'hello'\n", buf[:n], err)
+	}
+	s.Clunk(fid)
+
+	// Permissions are checked as for a client.
+	larry := fs.Connect("larry")
+	fid, err = larry.Walk("/moe/notes.txt")
+	if err != nil {
+		t.Fatalf("larry walk: %v\n", err)
+	}
+	if err = larry.Remove(fid); !errors.Is(err, ErrPerm) {
+		t.Errorf("larry remove: got %v, expected %v\n", err, ErrPerm)
+	}
+	if _, err = larry.Walk("/moe/missing.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("walk to a missing file: got %v, expected %v\n", err, ErrNotExist)
+	}
+
+	fid, err = s.Walk("/moe/notes.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	if err = s.Remove(fid); err != nil {
+		t.Errorf("remove: %v\n", err)
+	}
+	if _, err = os.Stat(filepath.Join(rootdir, "moe", "notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("notes.txt not removed: %v\n", err)
+	}
+
+	if _, err = fs.Connect("nobody").Walk("/"); err != ErrNoUser {
+		t.Errorf("unknown user: got %v, expected %v\n", err, ErrNoUser)
+	}
+}
+
+func TestSessionAccessors(t *testing.T) {
+
+	fs := newfs(rootdir)
+	fs.Ctl = true
+	s := fs.Connect("adm")
+
+	fid, err := s.Walk("/")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	_, err = s.Create(fid, "log", p.DMAPPEND|0644, p.OWRITE)
+	if err == nil {
+		_, err = s.Write(fid, []byte("entry\n"), 0)
+	}
+	s.Clunk(fid)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+
+	// Each accessor agrees with Stat.
+	for _, path := range []string{"/", "/moe-moe.txt", "/log", "/ctl/groups"} {
+		fid, err := s.Walk(path)
+		if err != nil {
+			t.Fatalf("walk %s: %v\n", path, err)
+		}
+		d, err := s.Stat(fid)
+		if err != nil {
+			t.Fatalf("stat %s: %v\n", path, err)
+		}
+		if q, err := s.Qid(fid); err != nil || *q != d.Qid {
+			t.Errorf("%s: Qid is %v, %v, expected %v\n", path, q, err, d.Qid)
+		}
+		if n, err := s.Length(fid); err != nil || n != d.Length {
+			t.Errorf("%s: Length is %d, %v, expected %d\n", path, n, err, d.Length)
+		}
+		if m, err := s.Mode(fid); err != nil || m != d.Mode {
+			t.Errorf("%s: Mode is %#o, %v, expected %#o\n", path, m, err, d.Mode)
+		}
+		if uid, err := s.Owner(fid); err != nil || uid != d.Uid {
+			t.Errorf("%s: Owner is '%s', %v, expected '%s'\n", path, uid, err, d.Uid)
+		}
+		s.Clunk(fid)
+
+		// Once clunked, the fid is gone.
+		if _, err := s.Length(fid); err == nil {
+			t.Errorf("%s: Length of a clunked fid\n", path)
+		}
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+
+	fs := newfs(rootdir)
+	adm := fs.Connect("adm")
+
+	// Three levels in one call.
+	err := adm.MkdirAll("/a/b/c", 0775)
+	if err != nil {
+		t.Fatalf("MkdirAll: %v\n", err)
+	}
+	for _, path := range []string{"/a", "/a/b", "/a/b/c"} {
+		fid, err := adm.Walk(path)
+		if err != nil {
+			t.Fatalf("walk %s: %v\n", path, err)
+		}
+		d, err := adm.Stat(fid)
+		adm.Clunk(fid)
+		if err != nil {
+			t.Fatalf("stat %s: %v\n", path, err)
+		}
+		if d.Mode&p.DMDIR == 0 || d.Uid != "adm" {
+			t.Errorf("%s: mode %#o owner %s, expected a directory owned by adm\n", path, d.Mode, d.Uid)
+		}
+	}
+
+	// Again, and deeper, is fine.
+	if err = adm.MkdirAll("/a/b/c/d", 0775); err != nil {
+		t.Errorf("MkdirAll over existing directories: %v\n", err)
+	}
+
+	// A file in the way is not.
+	if err = adm.MkdirAll("/moe-moe.txt/x", 0775); err != Enotdir {
+		t.Errorf("MkdirAll through a file: got %v, expected %v\n", err, Enotdir)
+	}
+
+	// moe can't write in /a, so can go no further than it.
+	moe := fs.Connect("moe")
+	if err = moe.MkdirAll("/a/m/n", 0775); err != ErrPerm {
+		t.Errorf("moe MkdirAll /a/m/n: got %v, expected %v\n", err, ErrPerm)
+	}
+	if _, err = os.Stat(rootdir + "/a/m"); !os.IsNotExist(err) {
+		t.Errorf("/a/m was created: %v\n", err)
+	}
+
+	// Sessions racing to create the same directories all succeed.
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			errs <- fs.Connect("adm").MkdirAll("/r/s/t", 0775)
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent MkdirAll: %v\n", err)
+		}
+	}
+	if st, err := os.Stat(rootdir + "/r/s/t"); err != nil || !st.IsDir() {
+		t.Errorf("/r/s/t: %v\n", err)
+	}
+}
@@ -12,3 +12,6 @@ import (
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atimespec.Unix())
 }
+
+// Open flag that keeps reads from updating the access time.
+const oNoatime = 0
@@ -12,3 +12,6 @@ import (
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atim.Unix())
 }
+
+// Open flag that keeps reads from updating the access time.
+const oNoatime = syscall.O_NOATIME
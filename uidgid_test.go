@@ -35,7 +35,7 @@ func TestAdmIsDefaultOwner(t *testing.T) {
 	}
 	defer os.RemoveAll(rootdir)
 
-	users, err := NewVusers(rootdir)
+	users, err := NewVusers(rootdir, "")
 	if err != nil {
 		t.Errorf("NewVusers(%s): %v\n", rootdir, err)
 
@@ -83,7 +83,7 @@ func TestUidGidHasEntry(t *testing.T) {
 		t.Fatalf("WriteFile(%s): err = %v\n", rootdir + "/" + uidgidFile, err)
 	}
 
-	users, err := NewVusers(rootdir)
+	users, err := NewVusers(rootdir, "")
 	if err != nil {
 		t.Errorf("NewVusers(%s): %v\n", rootdir, err)
 
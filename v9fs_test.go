@@ -0,0 +1,69 @@
+//go:build v9fs
+// +build v9fs
+
+package vufs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Mount the test server with the Linux kernel's 9p client, as in
+// the README, and use it as ls, cat and cp would.  Run as root with
+// go test -tags v9fs; the test is skipped if the mount fails.
+func TestKernelMount(t *testing.T) {
+
+	runserver(rootdir, port)
+
+	mnt, err := ioutil.TempDir("", "v9fs")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(mnt)
+
+	opts := "trans=tcp,port=" + strings.TrimPrefix(port, ":") + ",version=9p2000,uname=adm"
+	out, err := exec.Command("mount", "-t", "9p", "-o", opts, "127.0.0.1", mnt).CombinedOutput()
+	if err != nil {
+		t.Skipf("mount: %v: %s", err, out)
+	}
+	defer exec.Command("umount", mnt).Run()
+
+	// ls
+	fis, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatalf("ReadDir: %v\n", err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if got, want := strings.Join(names, ", "), "adm, larry-moe.txt, moe-moe.txt"; got != want {
+		t.Errorf("ls = '%s', expected '%s'\n", got, want)
+	}
+
+	// cat
+	data, err := ioutil.ReadFile(filepath.Join(mnt, "moe-moe.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if string(data) != initialFiles["/moe-moe.txt"].contents {
+		t.Errorf("cat = '%s'\n", data)
+	}
+
+	// cp
+	err = ioutil.WriteFile(filepath.Join(mnt, "copy.txt"), data, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	copied, err := ioutil.ReadFile(rootdir + "/copy.txt")
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if string(copied) != string(data) {
+		t.Errorf("copy = '%s', expected '%s'\n", copied, data)
+	}
+}
@@ -1,15 +1,20 @@
 package vufs
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,21 +24,246 @@ import (
 
 const uidgidFile = ".uidgid"
 
+// The longest file name (in bytes) that can be created.
+const maxFilename = 255
+
+// The largest packed stat, not counting its two-byte size field.
+const statMax = 65535
+
+// The most names a Twalk can have.
+const maxWelem = 16
+
+// 9P mode bits that are not kept on disk; they are kept in the
+// file's FileMeta.  The setuid and setgid bits are served but never
+// given to the file on disk, where they would act for the server's
+// user.
+const metaModeBits = p.DMAPPEND | p.DMEXCL | p.DMSETUID | p.DMSETGID
+
+var (
+	// Returned when the file a fid refers to has been removed
+	// from disk out from under the server.
+	Eremoved = &p.Error{"file removed", p.ENOENT}
+
+	// Returned when opening a DMEXCL file that is already open.
+	Eexcl = &p.Error{"exclusive use file already open", p.EPERM}
+
+	// Returned when a directory is opened for writing or written,
+	// and when a walk goes through a file that is not a directory.
+	Eisdir  = &p.Error{"is a directory", uint32(syscall.EISDIR)}
+	Enotdir = srv.Enotdir
+
+	Enametoolong  = &p.Error{"file name too long", uint32(syscall.ENAMETOOLONG)}
+	Estattoolarge = &p.Error{"stat too large", p.EINVAL}
+	Ebadname      = &p.Error{"invalid file name", p.EINVAL}
+	Etoomanyfids  = &p.Error{"too many fids", uint32(syscall.EMFILE)}
+	Erofs         = &p.Error{"read-only file system", uint32(syscall.EROFS)}
+	Etoomanywelem = &p.Error{"too many names in walk", p.EINVAL}
+	Enoversion    = &p.Error{"must send Tversion first", p.EINVAL}
+	Eoffset       = &p.Error{"offset out of range", p.EINVAL}
+)
+
+// The errors most often returned, for Go callers of the in-process
+// API to test with errors.Is.  They are go9p's errors, so clients
+// see the same messages on the wire.
+var (
+	ErrPerm     = srv.Eperm
+	ErrNotExist = srv.Enoent
+	ErrExist    = srv.Eexist
+	ErrNoUser   = srv.Enouser
+)
+
+// The number of fids a connection can have when MaxFids is zero.
+const defaultMaxFids = 4096
+
 type Fid struct {
-	path string
-	file *os.File
+	path   string
+	file   *os.File
+	rclose bool
+
+	// Set if this fid holds a DMEXCL file open; ino is the file's qid path.
+	excl bool
+	ino  uint64
+
+	// Decompressed contents of a gzip file opened for reading.
+	data []byte
+
+	// Set if writes go to the end of the file: it is append-only
+	// (DMAPPEND) or was opened with OAPPEND.
+	append bool
+
+	// Packed entries of a directory, built when it is read at offset
+	// zero; ends[i] is the offset just past entry i.  Later reads use
+	// this snapshot even if the directory changes on disk.
+	dirents []byte
+	ends    []int
+
+	// Set by the first Tclunk or Tremove of the fid.
+	clunked bool
+
+	// If not ctlNone, the synthetic file under /ctl the fid refers
+	// to; path is then the root.
+	ctl int
+
+	// Set when a Session opens the fid, with the mode it was opened
+	// in.  For clients, go9p keeps track.
+	opened bool
+	omode  uint8
+
+	// Set after a write through the fid, so clunking it knows the
+	// file changed.
+	wrote bool
+}
+
+// A Logger receives the server's messages; *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
+// Where messages go when VuFs.Logger is nil.
+var stderrLogger Logger = log.New(os.Stderr, "", log.LstdFlags)
+
 type VuFs struct {
 	srv.Srv
 	Root string
+
+	// If set, files whose names end in GzipSuffix are served
+	// decompressed and cannot be written.
+	GzipSuffix string
+
+	// The most bytes a file served decompressed may hold, since
+	// each fid that opens one keeps it all in memory; opening a
+	// larger one fails with Egziptoolarge.  If zero,
+	// defaultMaxGunzip.
+	MaxGunzip int64
+
+	// If set, attaches by users not in Upool run as this user.
+	Guest string
+
+	// Who owns files with no owner recorded, including the root;
+	// if empty, adm.  The user must be in Upool.
+	Owner string
+
+	// Where file ownership and other metadata are kept.  If nil,
+	// each directory's .uidgid file is used.
+	Store MetaStore
+
+	// If set, clients must authenticate before they can attach.
+	Authenticator Authenticator
+
+	// Where the server's messages go; if nil, to standard error.
+	// Most messages are only logged when Debuglevel > 0.
+	Logger Logger
+
+	// If set, serve the synthetic /ctl directory (see ctl.go).
+	Ctl bool
+
+	// The most fids a connection can have at once; attaches and
+	// walks to a new fid beyond it fail.  If zero, defaultMaxFids.
+	MaxFids int
+
+	// If set, a walk may pass through a symbolic link that resolves
+	// to a file under Root.  If not, walks to symbolic links fail,
+	// so a link cannot take a client out of the tree.
+	FollowSymlinks bool
+
+	// If set, reading a file does not update its access time.
+	// Only supported on Linux.
+	NoAtime bool
+
+	// If set, a connection is closed when the client has sent
+	// nothing for this long, which clunks its fids.
+	IdleTimeout time.Duration
+
+	// If set, a connection is closed when a reply to the client
+	// has not been taken after this long, so a client that stops
+	// reading cannot hold the server.
+	WriteTimeout time.Duration
+
+	// If set, TCP connections send keepalive probes this often, so
+	// a client that is gone, say behind a NAT that dropped the
+	// connection, is found and its fids clunked.  If zero, Go's
+	// default applies.  Other connections are left alone.
+	KeepAlive time.Duration
+
+	// If set, called with each request as it is answered, for an
+	// audit trail.  It is called on the request's goroutine, so it
+	// should not block.  Set before starting.
+	AccessLog func(*Access)
+
+	// The most bytes the files each user owns may hold, by user
+	// name; users not listed have no limit.  Set before starting.
+	Quota map[string]int64
+
+	// If set, directory reads omit entries the user cannot access.
+	filterDir bool
+
+	// If set, new files take the creator's group when the creator
+	// is not in the directory's group.
+	strictGroup bool
+
+	// If set, nothing can be created, written, removed or changed;
+	// guarded by mu.
+	readOnly bool
+
+	// Bytes used by users with a quota, found when first needed.
+	quotaMu sync.Mutex
+	used    map[string]int64
+
+	mu   sync.Mutex
+	excl map[uint64]bool
+
+	// Connections that have negotiated a version; guarded by mu.
+	versioned map[*srv.Conn]bool
+
+	// What Stop closes and Wait waits for; guarded by mu.
+	listeners map[net.Listener]bool
+	conns     map[*trackedConn]bool
+	running   sync.WaitGroup
+	started   bool
+	stopped   bool
+	done      chan struct{}
+
+	// Requests being handled, and closed when there are none
+	// left after StopWithContext starts waiting; guarded by mu.
+	reqs     int
+	reqsDone chan struct{}
+
+	// When each request arrived, if AccessLog is set; guarded by mu.
+	reqStart map[*srv.Req]time.Time
+
+	// Serializes changes to the tree and its .uidgid files.  Create,
+	// remove and wstat hold it for writing; lookups hold it for reading.
+	tree sync.RWMutex
+}
+
+// Stat the file a fid refers to.  Fids are resolved by path on
+// each request, so changes made on disk are seen immediately.
+func (fid *Fid) stat() (os.FileInfo, error) {
+	st, err := os.Stat(fid.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, Eremoved
+		}
+		return nil, toError(err)
+	}
+	return st, nil
+}
+
+// Report whether fid refers to a directory.
+func (fid *Fid) isDir() bool {
+	if fid.ctl != ctlNone {
+		return fid.ctl == ctlDir
+	}
+	st, err := fid.stat()
+	return err == nil && st.IsDir()
 }
 
 func toError(err error) *p.Error {
 	var ecode uint32
 
 	ename := err.Error()
-	if e, ok := err.(syscall.Errno); ok {
+	var e syscall.Errno
+	if errors.As(err, &e) {
 		ecode = uint32(e)
 	} else {
 		ecode = p.EIO
@@ -42,6 +272,39 @@ func toError(err error) *p.Error {
 	return &p.Error{ename, ecode}
 }
 
+// Like toError, but return the canonical error for a missing or
+// existing file or a permission failure.
+func osError(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return ErrNotExist
+	case os.IsExist(err):
+		return ErrExist
+	case os.IsPermission(err):
+		return ErrPerm
+	}
+	return toError(err)
+}
+
+// Check that name can be used for a new file: it must be a single
+// path element with no NUL or control characters, and not the name
+// of the ownership files.  Nor may it have a colon, which separates
+// the name from its owner in an ownership file.
+func validFilename(name string) error {
+	if len(name) > maxFilename {
+		return Enametoolong
+	}
+	if name == "" || name == "." || name == ".." || name == uidgidFile {
+		return Ebadname
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' || name[i] == ':' || name[i] < 0x20 {
+			return Ebadname
+		}
+	}
+	return nil
+}
+
 func omode2uflags(mode uint8) int {
 	ret := int(0)
 	switch mode & 3 {
@@ -65,6 +328,9 @@ func omode2uflags(mode uint8) int {
 	if mode&p.OTRUNC != 0 {
 		ret |= os.O_TRUNC
 	}
+	if mode&p.OAPPEND != 0 {
+		ret |= os.O_APPEND
+	}
 
 	return ret
 }
@@ -101,6 +367,15 @@ func dir2Npmode(d os.FileInfo) uint32 {
 		ret |= p.DMDIR
 	}
 
+	switch m := d.Mode(); {
+	case m&os.ModeNamedPipe != 0:
+		ret |= p.DMNAMEDPIPE
+	case m&os.ModeSocket != 0:
+		ret |= p.DMSOCKET
+	case m&os.ModeDevice != 0:
+		ret |= p.DMDEVICE
+	}
+
 	return ret
 }
 
@@ -124,59 +399,16 @@ func uid2name(id string, upool p.Users) (string, error) {
 }
 
 // Lookup (uid, gid) for a file (path = full path to file, e.g. './tmpfs/test.txt')
+// in its directory's .uidgid file.
 func path2UserGroup(path string, upool p.Users) (string, string, error) {
-
-	// Default owner/group is adm.
-	user := "adm"
-	group := "adm"
-
-	dn := filepath.Dir(path)
-	fn := filepath.Base(path)
-
-	data, err := ioutil.ReadFile(filepath.Join(dn, uidgidFile))
+	m, err := getMeta(sidecarStore{upool: upool}, path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return user, group, nil
-		} else {
-			return "", "", err
-		}
-	}
-
-	sdata := string(data)
-
-	for _, line := range strings.Split(sdata, "\n") {
-
-		if line == "#" {
-			continue
-		}
-
-		columns := strings.Split(line, ":")
-		if len(columns) != 3 {
-			continue
-		}
-
-		if columns[0] == fn {
-
-			user, err = uid2name(columns[1], upool)
-
-			if err != nil {
-				return "", "", err
-			}
-
-			group, err = uid2name(columns[2], upool)
-
-			if err != nil {
-				return "", "", err
-			}
-
-			break
-		}
+		return "", "", err
 	}
-
-	return user, group, nil
+	return m.Uid, m.Gid, nil
 }
 
-func dir2Dir(s string, d os.FileInfo, upool p.Users) (*p.Dir, error) {
+func dir2Dir(s string, d os.FileInfo, store MetaStore) (*p.Dir, error) {
 	sysif := d.Sys()
 	if sysif == nil {
 		return nil, &os.PathError{"dir2Dir", s, nil}
@@ -194,18 +426,53 @@ func dir2Dir(s string, d os.FileInfo, upool p.Users) (*p.Dir, error) {
 	dir.Mode = dir2Npmode(d)
 	dir.Atime = uint32(atime(sysMode).Unix())
 	dir.Mtime = uint32(d.ModTime().Unix())
-	dir.Length = uint64(d.Size())
+	// Directories, by convention, have a length of zero.
+	if !d.IsDir() {
+		dir.Length = uint64(d.Size())
+	}
 	dir.Name = s[strings.LastIndex(s, "/")+1:]
 
-	uid, gid, err := path2UserGroup(s, upool)
+	m, err := getMeta(store, s)
 	if err != nil {
 		return nil, err
 	}
-	dir.Uid, dir.Gid = uid, gid
+	dir.Uid, dir.Gid, dir.Muid = m.Uid, m.Gid, m.Muid
+	dir.Mode |= m.Mode & metaModeBits
+	dir.Qid.Type |= uint8((m.Mode & metaModeBits) >> 24)
 
 	return dir, nil
 }
 
+// Fill in the 9P2000.u fields of dir, the stat of the file at path:
+// numeric ids from Upool, and the target of a symbolic link.
+func (u *VuFs) setDotu(path string, dir *p.Dir) {
+	dir.Uidnum, dir.Gidnum, dir.Muidnum = p.NOUID, p.NOUID, p.NOUID
+	if u.Upool != nil {
+		if user := u.Upool.Uname2User(dir.Uid); user != nil {
+			dir.Uidnum = uint32(user.Id())
+		}
+		if group := u.Upool.Gname2Group(dir.Gid); group != nil {
+			dir.Gidnum = uint32(group.Id())
+		}
+		if user := u.Upool.Uname2User(dir.Muid); user != nil {
+			dir.Muidnum = uint32(user.Id())
+		}
+	}
+	if dir.Mode&p.DMSYMLINK != 0 {
+		dir.Ext, _ = os.Readlink(path)
+	}
+}
+
+// Return the packed size of a stat, not counting its size field.
+// See statsz in go9p/p/p9.go.
+func statSize(d *p.Dir, dotu bool) int {
+	n := 47 + len(d.Name) + len(d.Uid) + len(d.Gid) + len(d.Muid)
+	if dotu {
+		n += 14 + len(d.Ext)
+	}
+	return n
+}
+
 func mode2Perm(mode uint8) uint32 {
 	var perm uint32 = 0
 
@@ -216,6 +483,8 @@ func mode2Perm(mode uint8) uint32 {
 		perm = p.DMWRITE
 	case p.ORDWR:
 		perm = p.DMREAD | p.DMWRITE
+	case p.OEXEC:
+		perm = p.DMEXEC
 	}
 
 	if (mode & p.OTRUNC) != 0 {
@@ -272,432 +541,1450 @@ func CheckPerm(f *p.Dir, user p.User, perm uint32) bool {
 	return false
 }
 
-func (*VuFs) ConnOpened(conn *srv.Conn) {
-	if conn.Srv.Debuglevel > 0 {
-		log.Println("connected")
-	}
-}
+// Report whether the named user can read, write and execute
+// a file.  The path is relative to the file system root.
+func (u *VuFs) EffectivePerm(uname, path string) (read, write, exec bool, err error) {
+	u.tree.RLock()
+	defer u.tree.RUnlock()
 
-func (*VuFs) ConnClosed(conn *srv.Conn) {
-	if conn.Srv.Debuglevel > 0 {
-		log.Println("disconnected")
+	user := u.Upool.Uname2User(uname)
+	if user == nil {
+		return false, false, false, srv.Enouser
 	}
-}
 
-func (*VuFs) FidDestroy(sfid *srv.Fid) {
-	var fid *Fid
-
-	if sfid.Aux == nil {
-		return
+	fn, ctl, err := u.resolve(nil, path)
+	if err != nil {
+		return false, false, false, err
 	}
-
-	fid = sfid.Aux.(*Fid)
-	if fid != nil {
-		fid.file.Close()
+	if ctl != ctlNone {
+		return false, false, false, ErrPerm
 	}
-}
-
-// Always attach to the VuFs root.
-func (u *VuFs) Attach(req *srv.Req) {
-
-	if req.Tc.Aname != "/" && req.Tc.Aname != "" {
-		req.RespondError(srv.Eperm)
-		return
+	st, err := os.Stat(fn)
+	if err != nil {
+		return false, false, false, toError(err)
 	}
-
-	st, err := os.Stat(u.Root)
+	f, err := dir2Dir(fn, st, u.store())
 	if err != nil {
-		req.RespondError(toError(err))
-		return
+		return false, false, false, err
 	}
 
-	fid := new(Fid)
-	fid.path = u.Root
-	req.Fid.Aux = fid
+	read = CheckPerm(f, user, p.DMREAD)
+	write = CheckPerm(f, user, p.DMWRITE)
+	exec = CheckPerm(f, user, p.DMEXEC)
 
-	qid := dir2Qid(st)
-	req.RespondRattach(qid)
+	return read, write, exec, nil
 }
 
-func (*VuFs) Flush(req *srv.Req) {}
+// Report whether the named user could open the file at path with
+// perm, one or more of DMREAD, DMWRITE and DMEXEC, without opening
+// it.  Unlike EffectivePerm, the path is resolved as a walk would
+// be, so the user also needs search permission on the directories
+// on the way.  The error is ErrNotExist if there is no such file,
+// and Enotdir if the path goes through one that is not a directory.
+func (u *VuFs) CanAccess(uname, path string, perm uint32) (bool, error) {
+	user := u.Upool.Uname2User(uname)
+	if user == nil {
+		return false, ErrNoUser
+	}
 
-// BUG(mbucc) does not fully implement spec when fid = newfid.
-// From http://plan9.bell-labs.com/magic/man2html/5/walk:
-//	If newfid is the same as fid, the above discussion applies, with the
-//	obvious difference that if the walk changes the state of newfid, it
-//	also changes the state of fid; and if newfid is unaffected, then fid
-//	is also unaffected.
-//
-func (u *VuFs) Walk(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
-	tc := req.Tc
+	u.tree.RLock()
+	fpath, ctl, err := u.resolve(user, path)
+	u.tree.RUnlock()
+	if err == srv.Eperm {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
 
-	_, err := os.Stat(fid.path)
+	f, err := u.stat(&Fid{path: fpath, ctl: ctl})
+	if err == Eremoved {
+		return false, ErrNotExist
+	}
 	if err != nil {
-		req.RespondError(toError(err))
-		return
+		return false, err
 	}
 
-	if req.Newfid.Aux == nil {
-		req.Newfid.Aux = new(Fid)
+	switch {
+	case perm&p.DMWRITE != 0 && (u.isReadOnly() || ctl != ctlNone):
+		return false, nil
+	case u.isUsersFile(fpath) && user.Name() != f.Uid:
+		return false, nil
 	}
+	return CheckPerm(f, user, perm), nil
+}
 
-	newfid := req.Newfid.Aux.(*Fid)
-	wqids := make([]p.Qid, len(tc.Wname))
-	path := fid.path
-	i := 0
+// Log a message.
+func (u *VuFs) logf(format string, v ...interface{}) {
+	if u.Logger != nil {
+		u.Logger.Printf(format, v...)
+	} else {
+		stderrLogger.Printf(format, v...)
+	}
+}
 
-	// Ensure execute permission on the walk root.
-	st, err := os.Stat(path)
+// Log a message if Debuglevel > 0.
+func (u *VuFs) chatf(format string, v ...interface{}) {
+	if u.Debuglevel > 0 {
+		u.logf(format, v...)
+	}
+}
+
+// Check that the server can serve files: its root is a readable
+// directory and it has users, including Owner (or adm) and Guest if
+// set.  Ping does no 9P, so it is cheap enough for a liveness probe.
+func (u *VuFs) Ping() error {
+	if u.Upool == nil {
+		return fmt.Errorf("no users")
+	}
+	owner := u.Owner
+	if owner == "" {
+		owner = "adm"
+	}
+	if u.Upool.Uname2User(owner) == nil {
+		return fmt.Errorf("no user named '%s'", owner)
+	}
+	if u.Guest != "" && u.Upool.Uname2User(u.Guest) == nil {
+		return fmt.Errorf("no user named '%s'", u.Guest)
+	}
+
+	fp, err := os.Open(u.Root)
 	if err != nil {
-		req.RespondError(srv.Enoent)
-		return
+		return err
 	}
-	f, err := dir2Dir(path, st, req.Conn.Srv.Upool)
+	defer fp.Close()
+
+	st, err := fp.Stat()
 	if err != nil {
-		req.RespondError(toError(err))
-		return
+		return err
 	}
-	if !CheckPerm(f, req.Fid.User, p.DMEXEC) {
-		req.RespondError(srv.Eperm)
-		return
+	if !st.IsDir() {
+		return fmt.Errorf("root %s is not a directory", u.Root)
 	}
 
-	for ; i < len(tc.Wname); i++ {
+	return nil
+}
 
-		var newpath string
+// Choose whether directory listings show only the entries a user
+// can read (files) or search (directories).  By default, as in
+// Plan 9, all names are listed.
+func (u *VuFs) FilterDirByPerm(on bool) {
+	u.filterDir = on
+}
 
-		// Don't allow client to dotdot out of the file system root.
-		if tc.Wname[i] == ".." {
-			if path == u.Root {
-				continue
-			} else {
-				newpath = path[:strings.LastIndex(path, "/")]
-				if newpath == u.Root {
-					continue
-				}
-			}
-		} else {
-			newpath = path + "/" + tc.Wname[i]
-		}
+// Choose whether a new file always takes its directory's group (the
+// default), or, if the creator is not in that group, takes the
+// creator's own group instead.
+func (u *VuFs) StrictGroupInherit(on bool) {
+	u.strictGroup = on
+}
 
-		st, err := os.Stat(newpath)
-		if err != nil {
-			if i == 0 {
-				req.RespondError(srv.Enoent)
-				return
-			}
+// Choose whether the file system is read-only.  Files can then be
+// walked, opened for reading, read and stat'd, but any request to
+// change the tree fails with Erofs.
+func (u *VuFs) SetReadOnly(on bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-			break
-		}
+	u.readOnly = on
+}
 
-		wqids[i] = *dir2Qid(st)
+// Report whether the file system is read-only.
+func (u *VuFs) isReadOnly() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-		if (wqids[i].Type & p.QTDIR) > 0 {
-			f, err := dir2Dir(newpath, st, req.Conn.Srv.Upool)
-			if err != nil {
-				req.RespondError(toError(err))
-				return
-			}
-			if !CheckPerm(f, req.Fid.User, p.DMEXEC) {
-				req.RespondError(srv.Eperm)
-				return
-			}
-		}
+	return u.readOnly
+}
 
-		path = newpath
+// Return the group of a file user creates in a directory whose
+// group is dirgid.
+func (u *VuFs) newFileGroup(user p.User, dirgid string) string {
+	if u.strictGroup && !inGroup(user, dirgid) {
+		return user.Name()
+	}
+	return dirgid
+}
+
+// Report whether user is in the named group.
+func inGroup(user p.User, group string) bool {
+	for _, g := range user.Groups() {
+		if g.Name() == group {
+			return true
+		}
 	}
+	return false
+}
 
-	newfid.path = path
-	req.RespondRwalk(wqids[0:i])
+// Replace the users file (adm/users) with contents and start using
+// the new users.  Invalid contents, including any without Owner (or
+// adm), leave the file and users as they were.  Upool must have
+// been created with NewVusers.
+func (u *VuFs) SetUsers(contents []byte) error {
+	up, ok := u.Upool.(*vUsers)
+	if !ok {
+		return fmt.Errorf("users are not vufs users")
+	}
+	up.setOwner(u.Owner)
+	return up.set(contents)
 }
 
-func (u *VuFs) Open(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
-	tc := req.Tc
+// Re-read the users file (adm/users), for example after an admin
+// edits it, without dropping connections.  If the file doesn't
+// parse, the users stay as they were.  Upool must have been created
+// with NewVusers.  Clunking a fid that wrote the file over 9P
+// reloads it too.
+func (u *VuFs) ReloadUsers() error {
+	up, ok := u.Upool.(*vUsers)
+	if !ok {
+		return fmt.Errorf("users are not vufs users")
+	}
+	up.setOwner(u.Owner)
+	return up.Reload()
+}
 
-	// Ensure open permission.
-	st, err := os.Stat(fid.path)
-	if err != nil {
-		req.RespondError(srv.Enoent)
-		return
+// Report whether path is the users file Upool was loaded from.
+func (u *VuFs) isUsersFile(path string) bool {
+	up, ok := u.Upool.(*vUsers)
+	return ok && filepath.Clean(path) == filepath.Join(up.root, usersFile)
+}
+
+// Return Eperm if removing or renaming path would take the users
+// file away and user does not own it.  Whatever the permissions on
+// adm, only the users file's owner may do that.
+func (u *VuFs) checkUsersFile(path string, user p.User) error {
+	up, ok := u.Upool.(*vUsers)
+	if !ok {
+		return nil
 	}
-	f, err := dir2Dir(fid.path, st, req.Conn.Srv.Upool)
-	if err != nil {
-		req.RespondError(toError(err))
-		return
+	fn := filepath.Join(up.root, usersFile)
+	path = filepath.Clean(path)
+	if path != fn && !strings.HasPrefix(fn, path+"/") {
+		return nil
 	}
-	if !CheckPerm(f, req.Fid.User, mode2Perm(tc.Mode)) {
-		req.RespondError(srv.Eperm)
-		return
+	m, err := getMeta(u.store(), fn)
+	if err != nil {
+		return toError(err)
 	}
-
-	var e error
-	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
-	if e != nil {
-		req.RespondError(toError(e))
-		return
+	if user.Name() != m.Uid {
+		return srv.Eperm
 	}
-
-	req.RespondRopen(dir2Qid(st), 0)
+	return nil
 }
 
-func addUidGid(dir, file string, uid, gid int, fid *srv.Fid) error {
-
-	fid.Lock()
-	defer fid.Unlock()
+// Report whether path is the root or a file under it.
+func (u *VuFs) inRoot(path string) bool {
+	root := filepath.Clean(u.Root)
+	path = filepath.Clean(path)
+	return root == "/" || path == root || strings.HasPrefix(path, root+"/")
+}
 
-	fn0 := dir + "/" + uidgidFile
-	//fn1 := fn0 + ".tmp"
+// Check that a walk may go to path.  If it is a symbolic link, it
+// must resolve to a file under the root and FollowSymlinks be set.
+func (u *VuFs) checkLink(path string) error {
+	st, err := os.Lstat(path)
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if !u.FollowSymlinks {
+		return srv.Eperm
+	}
 
-	fp0, err := os.OpenFile(fn0, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	target, err := filepath.EvalSymlinks(path)
 	if err != nil {
-		return err
+		return srv.Enoent
 	}
-
-	defer fp0.Close()
-
-	_, err = fp0.WriteString(fmt.Sprintf("%s:%d:%d\n", file, uid, gid))
+	root, err := filepath.EvalSymlinks(u.Root)
 	if err != nil {
-		// BUG(mbucc) Roll back  bytes written to .uidgid on error.
-		return err
+		return toError(err)
 	}
-
-/*
-
-	fp0, err := os.OpenFile(fn0, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	if err == nil {
-		defer fp0.Close()
-		_, err = fp0.WriteString(fmt.Sprintf("%s:%s:%s\n", file, uid, uid))
-
-	switch err {
-	case nil:
-
-	if err == nil && os.IsNotExist(err){
-		return err
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return srv.Eperm
 	}
+	return nil
+}
 
-	if err != nil {
-
+// Mark fid as clunked, reporting false if it already was.  A client
+// can send Tclunk and Tremove for a fid without waiting for either
+// reply; only the first may release the fid.
+func (u *VuFs) clunkFid(fid *Fid) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
+	if fid.clunked {
+		return false
+	}
+	fid.clunked = true
+	return true
+}
 
+// Mark a DMEXCL file as held open by fid.
+func (u *VuFs) holdExcl(fid *Fid, ino uint64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-*/
+	if u.excl == nil {
+		u.excl = make(map[uint64]bool)
+	}
+	if u.excl[ino] {
+		return Eexcl
+	}
+	u.excl[ino] = true
+	fid.excl, fid.ino = true, ino
 
 	return nil
 }
 
+// Release a DMEXCL file held open by fid, if any.
+func (u *VuFs) releaseExcl(fid *Fid) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-func (*VuFs) Create(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
+	if fid.excl {
+		delete(u.excl, fid.ino)
+		fid.excl = false
+	}
+}
+
+// Map unknown users to the guest user (if any) before the request
+// is processed; otherwise attach fails with "unknown user".
+//
+// Reads are clamped to what fits in the connection's negotiated
+// msize, so a client asking for more gets a short read rather
+// than an error.
+//
+// Requests other than Tversion fail until a Tversion succeeds.
+func (u *VuFs) ReqProcess(req *srv.Req) {
 	tc := req.Tc
 
-	parentPath := fid.path
+	u.beginReq()
+	defer u.endReq()
+	u.beginAccess(req)
 
-	// User must be able to write to parent directory.
-	st, err := os.Stat(parentPath)
-	if err != nil {
-		req.RespondError(toError(err))
-		return
-	}
-	f, err := dir2Dir(parentPath, st, req.Conn.Srv.Upool)
-	if err != nil {
-		req.RespondError(toError(err))
-		return
-	}
-	if !CheckPerm(f, req.Fid.User, p.DMWRITE) {
-		req.RespondError(srv.Eperm)
+	if tc.Type != p.Tversion && !u.isVersioned(req.Conn) {
+		req.RespondError(Enoversion)
 		return
 	}
 
-	path := parentPath + "/" + tc.Name
-	var e error = nil
-	var file *os.File = nil
-	switch {
-	case tc.Perm&p.DMDIR != 0:
-		e = os.Mkdir(path, os.FileMode(tc.Perm&0777))
-		if e == nil {
-			file, e = os.OpenFile(path, omode2uflags(tc.Mode), 0)
-		}
-
-	case tc.Perm&p.DMSYMLINK != 0,
-			tc.Perm&p.DMLINK != 0,
-			tc.Perm&p.DMNAMEDPIPE != 0,
-			tc.Perm&p.DMDEVICE != 0,
-			tc.Perm&p.DMSOCKET != 0,
-			tc.Perm&p.DMSETUID != 0,
-			tc.Perm&p.DMSETGID != 0:
-		req.RespondError(srv.Ebaduse)
+	if newFid(tc) && u.fidCount(req.Conn) >= u.maxFids() {
+		req.RespondError(Etoomanyfids)
 		return
+	}
 
-	default:
-		var mode uint32 = tc.Perm & 0777
-		file, e = os.OpenFile(path,
-			omode2uflags(tc.Mode)|os.O_CREATE,
-			os.FileMode(mode))
+	if tc.Type == p.Tread {
+		if max := req.Conn.Msize - p.IOHDRSZ; tc.Count > max {
+			tc.Count = max
+		}
 	}
 
-	if e != nil {
-		req.RespondError(toError(e))
-		return
+	if u.Guest != "" && (tc.Type == p.Tattach || tc.Type == p.Tauth) {
+		known := u.Upool.Uname2User(tc.Uname) != nil
+		if !known && tc.Unamenum != p.NOUID {
+			known = u.Upool.Uid2User(int(tc.Unamenum)) != nil
+		}
+		if !known {
+			tc.Uname = u.Guest
+			tc.Unamenum = p.NOUID
+		}
 	}
 
-	fid.path = path
-	fid.file = file
-	st, err = os.Stat(fid.path)
+	req.Process()
+}
+
+func (u *VuFs) isVersioned(conn *srv.Conn) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.versioned[conn]
+}
+
+func (u *VuFs) setVersioned(conn *srv.Conn, on bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !on {
+		delete(u.versioned, conn)
+		return
+	}
+	if u.versioned == nil {
+		u.versioned = make(map[*srv.Conn]bool)
+	}
+	u.versioned[conn] = true
+}
+
+// Report whether a request allocates a fid.
+func newFid(tc *p.Fcall) bool {
+	switch tc.Type {
+	case p.Tattach, p.Tauth:
+		return true
+	case p.Twalk:
+		return tc.Newfid != tc.Fid
+	}
+	return false
+}
+
+func (u *VuFs) maxFids() int {
+	if u.MaxFids > 0 {
+		return u.MaxFids
+	}
+	return defaultMaxFids
+}
+
+// Return the number of fids in use on conn.
+func (*VuFs) fidCount(conn *srv.Conn) int {
+	conn.Lock()
+	defer conn.Unlock()
+	return len(conn.Fidpool)
+}
+
+// Return the errno to send a 9P2000.u client for the error in
+// reply to req, where go9p's own is not what a Unix client expects,
+// or zero.
+func dotuErrno(req *srv.Req) uint32 {
+	if req.Rc.Error != srv.Eperm.(*p.Error).Err {
+		return 0
+	}
+	return uint32(syscall.EACCES)
+}
+
+// Return Eisdir if req failed because go9p refused to open a
+// directory for writing (with Eperm) or to write to one (with
+// Ebaduse), or nil.
+func dirError(req *srv.Req) *p.Error {
+	tc := req.Tc
+	if req.Fid == nil || req.Fid.Type&p.QTDIR == 0 {
+		return nil
+	}
+	switch {
+	case tc.Type == p.Topen && (mode2Perm(tc.Mode)&p.DMWRITE != 0 || tc.Mode&p.OTRUNC != 0):
+		return Eisdir
+	case tc.Type == p.Twrite:
+		return Eisdir
+	}
+	return nil
+}
+
+// If a Tclunk or Tremove lost the race to clunk its fid, drop only
+// the request's reference; the winner drops the fid's own.
+//
+// A walk that stops part way leaves newfid as it was.
+//
+// Opening a directory for writing, or writing to one, fails with
+// Eisdir.
+//
+// On 9P2000.u connections, errors carry the errno from dotuErrno.
+//
+// Each reply is counted in metrics and given to AccessLog.
+func (u *VuFs) ReqRespond(req *srv.Req) {
+	tc, rc := req.Tc, req.Rc
+
+	var uname string
+	if req.Fid != nil && req.Fid.User != nil {
+		uname = req.Fid.User.Name()
+	}
+	countReply(tc.Type, rc, uname)
+
+	if tc.Type == p.Tversion && rc != nil {
+		u.setVersioned(req.Conn, rc.Type == p.Rversion)
+	}
+
+	// Otherwise go9p would give newfid the type of the last qid,
+	// and keep newfid with it if it is fid.
+	if tc.Type == p.Twalk && req.Newfid != nil &&
+		rc != nil && rc.Type == p.Rwalk && len(rc.Wqid) != len(tc.Wname) {
+		req.Newfid.DecRef()
+		req.Newfid = nil
+	}
+
+	if rc != nil && rc.Type == p.Rerror {
+		if e := dirError(req); e != nil {
+			p.PackRerror(rc, e.Err, e.Errornum, req.Conn.Dotu)
+		}
+	}
+
+	if req.Conn.Dotu && rc != nil && rc.Type == p.Rerror {
+		if errno := dotuErrno(req); errno != 0 && rc.Errornum != errno {
+			p.PackRerror(rc, rc.Error, errno, true)
+		}
+	}
+
+	if (tc.Type == p.Tclunk || tc.Type == p.Tremove) && req.Fid != nil &&
+		rc != nil && rc.Type == p.Rerror && rc.Error == srv.Eunknownfid.(*p.Error).Err {
+		req.Fid.DecRef()
+		req.Fid = nil
+	}
+
+	u.logAccess(req)
+	req.PostProcess()
+}
+
+func (u *VuFs) ConnOpened(conn *srv.Conn) {
+	u.chatf("connected %s", remoteAddr(conn))
+	metrics.Add("connections", 1)
+
+	if c := netConn(conn); c != nil {
+		c.conn = conn
+	}
+}
+
+func (u *VuFs) ConnClosed(conn *srv.Conn) {
+	u.chatf("disconnected %s", remoteAddr(conn))
+	metrics.Add("connections", -1)
+	u.setVersioned(conn, false)
+
+	// go9p stops reading after an error or EOF but leaves the socket open.
+	if c := netConn(conn); c != nil {
+		c.Close()
+		u.removeConn(c)
+	}
+}
+
+func (u *VuFs) FidDestroy(sfid *srv.Fid) {
+	// Auth fids may hold an Authenticator's state.
+	fid, ok := sfid.Aux.(*Fid)
+	if ok && fid != nil {
+		u.destroyFid(fid)
+		metrics.Add("fids", -1)
+	}
+}
+
+// Release what an open fid holds.  Each fid that has a file open,
+// whether by open or create, has its own handle, closed here once.
+func (u *VuFs) destroyFid(fid *Fid) {
+	if fid.file != nil {
+		fid.file.Close()
+		fid.file = nil
+	}
+	u.releaseExcl(fid)
+}
+
+// Always attach to the VuFs root.
+func (u *VuFs) Attach(req *srv.Req) {
+
+	if req.Tc.Aname != "/" && req.Tc.Aname != "" {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	st, err := os.Stat(u.Root)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	fid := new(Fid)
+	fid.path = u.Root
+	req.Fid.Aux = fid
+	metrics.Add("fids", 1)
+
+	u.chatf("attach %s", req.Fid.User.Name())
+
+	qid := dir2Qid(st)
+	req.RespondRattach(qid)
+}
+
+func (*VuFs) Flush(req *srv.Req) {}
+
+// From http://plan9.bell-labs.com/magic/man2html/5/walk:
+//	If newfid is the same as fid, the above discussion applies, with the
+//	obvious difference that if the walk changes the state of newfid, it
+//	also changes the state of fid; and if newfid is unaffected, then fid
+//	is also unaffected.
+//
+// A walk that stops part way leaves newfid unaffected; ReqRespond
+// keeps go9p from installing it.  go9p refuses a newfid that is in
+// use and is not fid, with or without names to walk.
+func (u *VuFs) Walk(req *srv.Req) {
+	// Auth fids have no file behind them.
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if len(req.Tc.Wname) > maxWelem {
+		req.RespondError(Etoomanywelem)
+		return
+	}
+
+	path, ctl, wqids, err := u.walk(fid, req.Fid.User, req.Tc.Wname)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if len(wqids) == len(req.Tc.Wname) {
+		if req.Newfid.Aux == nil {
+			req.Newfid.Aux = new(Fid)
+			metrics.Add("fids", 1)
+		}
+		newfid := req.Newfid.Aux.(*Fid)
+		newfid.path = path
+		newfid.ctl = ctl
+	}
+	req.RespondRwalk(wqids)
+}
+
+// Find the file at path, relative to the root, as a walk from the
+// root by user would, and return its path on disk and synthetic
+// file.  So the user needs search permission on the directories on
+// the way (unless user is nil), and neither a symbolic link nor a
+// name can take the path out of the tree.  The caller holds the
+// tree lock.
+func (u *VuFs) resolve(user p.User, path string) (string, int, error) {
+	names := splitPath(path)
+	fpath, ctl, qids, err := u.walkLocked(&Fid{path: u.Root}, user, names)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(qids) != len(names) {
+		if len(qids) > 0 && qids[len(qids)-1].Type&p.QTDIR == 0 {
+			return "", 0, Enotdir
+		}
+		return "", 0, ErrNotExist
+	}
+	return fpath, ctl, nil
+}
+
+// Split a path relative to the root into the names to walk.
+func splitPath(path string) []string {
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Walk names from fid on behalf of user, returning the path and
+// synthetic file walked to and the qids of the names walked.  As in
+// 9P, it is an error only if the first name cannot be walked.
+func (u *VuFs) walk(fid *Fid, user p.User, names []string) (string, int, []p.Qid, error) {
+	u.tree.RLock()
+	defer u.tree.RUnlock()
+
+	return u.walkLocked(fid, user, names)
+}
+
+// Walk as walk does, with the tree lock held.  If user is nil, no
+// permissions are checked.
+func (u *VuFs) walkLocked(fid *Fid, user p.User, names []string) (string, int, []p.Qid, error) {
+	_, err := fid.stat()
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	wqids := make([]p.Qid, len(names))
+	path := fid.path
+	ctl := fid.ctl
+	i := 0
+
+	// Ensure execute permission on the walk root.
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", 0, nil, srv.Enoent
+	}
+	f, err := dir2Dir(path, st, u.store())
+	if err != nil {
+		return "", 0, nil, toError(err)
+	}
+	if user != nil && !CheckPerm(f, user, p.DMEXEC) {
+		return "", 0, nil, srv.Eperm
+	}
+
+	for ; i < len(names); i++ {
+
+		var newpath string
+
+		if u.Ctl && (ctl != ctlNone || path == u.Root && names[i] == ctlName) {
+			qid, next, ok := u.ctlWalk(ctl, names[i])
+			if !ok {
+				if i == 0 {
+					return "", 0, nil, srv.Enoent
+				}
+				break
+			}
+			wqids[i] = qid
+			ctl = next
+			continue
+		}
+
+		// Don't allow client to dotdot out of the file system root.
+		if names[i] == ".." {
+			newpath = path
+			if path != u.Root {
+				newpath = path[:strings.LastIndex(path, "/")]
+			}
+		} else if strings.Contains(names[i], "/") {
+			// No file has such a name; don't let it walk
+			// several levels, or out of the root.
+			if i == 0 {
+				return "", 0, nil, srv.Enoent
+			}
+			break
+		} else {
+			newpath = path + "/" + names[i]
+			if err := u.checkLink(newpath); err != nil {
+				if i == 0 {
+					return "", 0, nil, err
+				}
+				break
+			}
+		}
+
+		// Whatever the name, never leave the tree.
+		if !u.inRoot(newpath) {
+			if i == 0 {
+				return "", 0, nil, srv.Eperm
+			}
+			break
+		}
+
+		st, err := os.Stat(newpath)
+		if err != nil {
+			if i == 0 {
+				return "", 0, nil, srv.Enoent
+			}
+
+			break
+		}
+
+		wqids[i] = *dir2Qid(st)
+
+		if (wqids[i].Type & p.QTDIR) > 0 {
+			f, err := dir2Dir(newpath, st, u.store())
+			if err != nil {
+				return "", 0, nil, toError(err)
+			}
+			if user != nil && !CheckPerm(f, user, p.DMEXEC) {
+				return "", 0, nil, srv.Eperm
+			}
+		}
+
+		path = newpath
+	}
+
+	return path, ctl, wqids[0:i], nil
+}
+
+func (u *VuFs) Open(req *srv.Req) {
+	// Auth fids have no file behind them.
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	qid, err := u.open(fid, req.Fid.User, req.Tc.Mode)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRopen(qid, 0)
+}
+
+// Open the file fid refers to on behalf of user.
+func (u *VuFs) open(fid *Fid, user p.User, mode uint8) (*p.Qid, error) {
+	u.tree.RLock()
+	defer u.tree.RUnlock()
+
+	if u.isReadOnly() && (mode2Perm(mode)&p.DMWRITE != 0 || mode&(p.OTRUNC|p.ORCLOSE) != 0) {
+		return nil, Erofs
+	}
+
+	// Synthetic files can only be read.
+	if fid.ctl != ctlNone {
+		if mode&^p.OCEXEC != p.OREAD {
+			return nil, srv.Eperm
+		}
+		fid.data = ctlData(fid.ctl, user)
+		qid := ctlQid(fid.ctl)
+		return &qid, nil
+	}
+
+	// Ensure open permission.
+	st, err := fid.stat()
+	if err != nil {
+		return nil, err
+	}
+	f, err := dir2Dir(fid.path, st, u.store())
+	if err != nil {
+		return nil, toError(err)
+	}
+	if !CheckPerm(f, user, mode2Perm(mode)) {
+		return nil, srv.Eperm
+	}
+
+	// Only its owner may open the users file, whatever its mode.
+	if u.isUsersFile(fid.path) && user.Name() != f.Uid {
+		return nil, srv.Eperm
+	}
+
+	// ORCLOSE requires permission to remove the file from its parent.
+	if mode&p.ORCLOSE != 0 {
+		err = u.checkParentWrite(fid.path, user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only one fid at a time may hold an exclusive use file open.
+	if f.Mode&p.DMEXCL != 0 {
+		err = u.holdExcl(fid, f.Qid.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gzipped := !st.IsDir() && u.gzipped(fid.path)
+	if gzipped && mode2Perm(mode)&p.DMWRITE != 0 {
+		return nil, Ecompressed
+	}
+
+	// Append-only files are never truncated, and writes go to the end.
+	flags := omode2uflags(mode)
+	if f.Mode&p.DMAPPEND != 0 {
+		flags = flags&^os.O_TRUNC | os.O_APPEND
+	}
+
+	var e error
+	if u.NoAtime {
+		fid.file, e = os.OpenFile(fid.path, flags|oNoatime, 0)
+		// Only the file's owner can use O_NOATIME.
+		if os.IsPermission(e) {
+			fid.file, e = os.OpenFile(fid.path, flags, 0)
+		}
+	} else {
+		fid.file, e = os.OpenFile(fid.path, flags, 0)
+	}
+	if e != nil {
+		u.releaseExcl(fid)
+		return nil, osError(e)
+	}
+	if gzipped {
+		fid.data, err = gunzip(fid.file, u.maxGunzip())
+		if err != nil {
+			fid.file.Close()
+			fid.file = nil
+			u.releaseExcl(fid)
+			return nil, err
+		}
+	}
+	fid.rclose = mode&p.ORCLOSE != 0
+	fid.append = f.Mode&p.DMAPPEND != 0 || mode&p.OAPPEND != 0
+	// Truncating changes the file even if nothing is written.
+	fid.wrote = flags&os.O_TRUNC != 0
+
+	return &f.Qid, nil
+}
+
+// Return an error unless user can write to the directory holding path.
+func (u *VuFs) checkParentWrite(path string, user p.User) error {
+
+	parent := filepath.Dir(path)
+	st, err := os.Stat(parent)
+	if err != nil {
+		return osError(err)
+	}
+	f, err := dir2Dir(parent, st, u.store())
+	if err != nil {
+		return toError(err)
+	}
+	if !CheckPerm(f, user, p.DMWRITE) {
+		return srv.Eperm
+	}
+
+	return nil
+}
+
+// Remove a file and its ownership entry on behalf of user.
+func (u *VuFs) remove(path string, user p.User) error {
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	if u.isReadOnly() {
+		return Erofs
+	}
+
+	err := u.checkParentWrite(path, user)
+	if err != nil {
+		return err
+	}
+	err = u.checkUsersFile(path, user)
+	if err != nil {
+		return err
+	}
+
+	owner, size, err := u.quotaOwner(path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return osError(err)
+	}
+	u.chargeQuota(owner, -size)
+
+	err = u.store().Delete(path)
+	if err != nil {
+		return toError(err)
+	}
+
+	return nil
+}
+
+func (u *VuFs) Create(req *srv.Req) {
+	// Auth fids have no file behind them.
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	tc := req.Tc
+
+	qid, err := u.create(fid, req.Fid.User, tc.Name, tc.Perm, tc.Mode)
 	if err != nil {
-		file.Close()
-		fid.file = nil
 		req.RespondError(err)
 		return
 	}
 
-	// BUG(mbucc): Redesign data structures so I can remove this panic.
-	_, dirgid, err := path2UserGroup(parentPath, req.Conn.Srv.Upool)
+	req.RespondRcreate(qid, 0)
+}
+
+// Create and open the file name in the directory fid refers to, on
+// behalf of user.  Fid then refers to the new file.
+func (u *VuFs) create(fid *Fid, user p.User, name string, perm uint32, mode uint8) (*p.Qid, error) {
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	if u.isReadOnly() {
+		return nil, Erofs
+	}
+
+	if fid.ctl != ctlNone {
+		return nil, srv.Eperm
+	}
+
+	parentPath := fid.path
+
+	err := validFilename(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// User must be able to write to parent directory.
+	st, err := os.Stat(parentPath)
+	if err != nil {
+		return nil, osError(err)
+	}
+	f, err := dir2Dir(parentPath, st, u.store())
 	if err != nil {
-		panic(fmt.Sprintf("no uid/gid found for parent directory '%s'", parentPath))
+		return nil, toError(err)
+	}
+	if !CheckPerm(f, user, p.DMWRITE) {
+		return nil, srv.Eperm
+	}
+	err = u.checkQuota(user.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	path := parentPath + "/" + name
+	if perm&p.DMDIR == 0 && u.gzipped(path) {
+		return nil, Ecompressed
+	}
+
+	var e error = nil
+	var file *os.File = nil
+	switch {
+	case perm&p.DMDIR != 0:
+		// Directories are read by name, so no handle is kept.
+		e = os.Mkdir(path, os.FileMode(perm&0777))
+
+	case perm&p.DMSYMLINK != 0,
+			perm&p.DMLINK != 0,
+			perm&p.DMNAMEDPIPE != 0,
+			perm&p.DMDEVICE != 0,
+			perm&p.DMSOCKET != 0:
+		return nil, srv.Ebaduse
+
+	default:
+		flags := omode2uflags(mode) | os.O_CREATE | os.O_EXCL
+		if perm&p.DMAPPEND != 0 {
+			flags |= os.O_APPEND
+		}
+		file, e = os.OpenFile(path, flags, os.FileMode(perm&0777))
 	}
-	gu := req.Conn.Srv.Upool.Uname2User(dirgid)
-	if gu == nil {
-		panic(fmt.Sprintf("no user for parent directory gid %d", dirgid))
+
+	if e != nil {
+		return nil, osError(e)
 	}
-	
-	err = addUidGid(parentPath, tc.Name, req.Fid.User.Id(), gu.Id(), req.Fid)
+
+	fid.path = path
+	fid.file = file
+	st, err = os.Stat(fid.path)
 	if err != nil {
 		file.Close()
 		fid.file = nil
-		req.RespondError(err)
-		return
+		return nil, osError(err)
+	}
+
+	gid := u.newFileGroup(user, f.Gid)
+	qid := dir2Qid(st)
+	qid.Type |= uint8((perm & metaModeBits) >> 24)
+	err = u.store().Set(path, FileMeta{
+		Uid:  user.Name(),
+		Gid:  gid,
+		Muid: user.Name(),
+		Mode: perm & metaModeBits,
+	})
+	if err != nil {
+		file.Close()
+		fid.file = nil
+		return nil, err
+	}
+
+	// The new file is open, so an exclusive use file is now held.
+	if perm&p.DMEXCL != 0 {
+		err = u.holdExcl(fid, qid.Path)
+		if err != nil {
+			file.Close()
+			fid.file = nil
+			return nil, err
+		}
 	}
 
-	req.RespondRcreate(dir2Qid(st), 0)
+	fid.rclose = mode&p.ORCLOSE != 0
+	fid.append = perm&p.DMAPPEND != 0 || mode&p.OAPPEND != 0
+
+	return qid, nil
 }
 
 func (u *VuFs) Read(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
+	// Auth fids have no file behind them.
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
 	tc := req.Tc
 	rc := req.Rc
-	st, err := os.Stat(fid.path)
+
+	p.InitRread(rc, tc.Count)
+	count, err := u.read(fid, req.Fid.User, rc.Data, tc.Offset, req.Conn.Dotu)
 	if err != nil {
 		req.RespondError(err)
 		return
 	}
 
-	p.InitRread(rc, tc.Count)
+	p.SetRreadCount(rc, uint32(count))
+	req.Respond()
+}
+
+// Read into buf from the file or directory open on fid, on behalf
+// of user.  Directory entries are packed for 9P2000.u if dotu is set.
+func (u *VuFs) read(fid *Fid, user p.User, buf []byte, offset uint64, dotu bool) (int, error) {
+	st, err := fid.stat()
+	if err != nil {
+		return 0, err
+	}
+
 	var count int
 	var e error
-	if st.IsDir() {
-		// Simpler to treat non-zero offset as an error for directories.
-		if tc.Offset != 0 {
-			req.RespondError(srv.Ebadoffset)
-			return
+	if st.IsDir() && fid.ctl != ctlGroups {
+		if offset == 0 {
+			if fid.ctl == ctlDir {
+				fid.dirents, fid.ends = ctlPackDir(dotu)
+			} else {
+				fid.dirents, fid.ends, err = u.packDir(fid.path, user, dotu)
+			}
+			if err != nil {
+				return 0, toError(err)
+			}
 		}
 
-		dirs, e := fid.file.Readdir(-1)
-
-		if e != nil {
-			req.RespondError(toError(e))
-			return
+		// The offset must be zero or the end of an entry returned
+		// by a previous read, and only whole entries are returned.
+		if offset > uint64(len(fid.dirents)) {
+			return 0, srv.Ebadoffset
 		}
-
-		// Bytes/one packed dir = 49 + len(name) + len(uid) + len(gid) + len(muid)
-		// Estimate 49 + 20 + 20 + 20 + 11
-		// From ../../lionkov/go9p/p/p9.go:421,427
-		dirents := make([]byte, 0, 120 * len(dirs))
-		for i := 0; i < len(dirs); i++ {
-			path := fid.path + "/" + dirs[i].Name()
-			st, err := dir2Dir(path, dirs[i], req.Conn.Srv.Upool)
-			if err != nil {
-				req.RespondError(toError(err))
-				return
+		off := int(offset)
+		first := 0
+		if off > 0 {
+			i := sort.SearchInts(fid.ends, off)
+			if i == len(fid.ends) || fid.ends[i] != off {
+				return 0, srv.Ebadoffset
 			}
-			b := p.PackDir(st, false)
-			dirents = append(dirents, b...)
+			first = i + 1
 		}
 
-		if len(dirents) > int(tc.Count) {
-			req.RespondError(srv.Etoolarge)
-			return
+		end := off
+		for i := first; i < len(fid.ends) && fid.ends[i]-off <= len(buf); i++ {
+			end = fid.ends[i]
+		}
+		if end == off && first < len(fid.ends) {
+			return 0, srv.Etoolarge
 		}
 
-		copy(rc.Data, dirents)
-
-		count = len(dirents)
+		count = copy(buf, fid.dirents[off:end])
 
-	} else {
-		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
+	} else if fid.data != nil || fid.ctl != ctlNone {
+		if offset < uint64(len(fid.data)) {
+			count = copy(buf, fid.data[offset:])
+		}
+	} else if offset <= math.MaxInt64-uint64(len(buf)) {
+		// Further on is past the end of any file.
+		count, e = fid.file.ReadAt(buf, int64(offset))
 		if e != nil && e != io.EOF {
-			req.RespondError(toError(e))
-			return
+			return 0, toError(e)
 		}
 	}
-	p.SetRreadCount(rc, uint32(count))
-	req.Respond()
+	return count, nil
 }
 
-func (*VuFs) Write(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
-	tc := req.Tc
-	_, err := os.Stat(fid.path)
+// Pack the entries of a directory, sorted by name, for user.
+func (u *VuFs) packDir(path string, user p.User, dotu bool) ([]byte, []int, error) {
+	u.tree.RLock()
+	defer u.tree.RUnlock()
+
+	dirs, err := ioutil.ReadDir(path)
 	if err != nil {
-		req.RespondError(toError(err))
+		return nil, nil, err
+	}
+
+	// Bytes/one packed dir = 49 + len(name) + len(uid) + len(gid) + len(muid)
+	// Estimate 49 + 20 + 20 + 20 + 11
+	// From ../../lionkov/go9p/p/p9.go:421,427
+	dirents := make([]byte, 0, 120*len(dirs))
+	ends := make([]int, 0, len(dirs))
+	for i := 0; i < len(dirs); i++ {
+		fn := path + "/" + dirs[i].Name()
+		// Skip entries that cannot be stat'ed, such as ones
+		// removed since ReadDir.
+		st, err := u.dir2Dir(fn, dirs[i])
+		if err != nil {
+			u.chatf("stat %s: %v", fn, err)
+			continue
+		}
+		if u.filterDir {
+			perm := uint32(p.DMREAD)
+			if dirs[i].IsDir() {
+				perm = p.DMEXEC
+			}
+			if !CheckPerm(st, user, perm) {
+				continue
+			}
+		}
+		// Skip entries that cannot be packed.
+		if statSize(st, dotu) > statMax {
+			continue
+		}
+		dirents = append(dirents, p.PackDir(st, dotu)...)
+		ends = append(ends, len(dirents))
+	}
+
+	return dirents, ends, nil
+}
+
+func (u *VuFs) Write(req *srv.Req) {
+	// Auth fids have no file behind them.
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil {
+		req.RespondError(srv.Eperm)
 		return
 	}
+	tc := req.Tc
 
-	n, e := fid.file.WriteAt(tc.Data, int64(tc.Offset))
-	if e != nil {
-		req.RespondError(toError(e))
+	n, err := u.write(fid, req.Fid.User, tc.Data, tc.Offset)
+	if err != nil {
+		req.RespondError(err)
 		return
 	}
 
 	req.RespondRwrite(uint32(n))
 }
 
-func (*VuFs) Clunk(req *srv.Req) { req.RespondRclunk() }
+// Write data to the file open on fid, on behalf of user.
+func (u *VuFs) write(fid *Fid, user p.User, data []byte, offset uint64) (int, error) {
+	if u.isReadOnly() {
+		return 0, Erofs
+	}
 
-func (*VuFs) Remove(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
-	_, err := os.Stat(fid.path)
+	_, err := fid.stat()
 	if err != nil {
-		req.RespondError(toError(err))
-		return
+		return 0, err
+	}
+
+	if u.gzipped(fid.path) {
+		return 0, Ecompressed
+	}
+
+	// No file can reach past the largest int64 offset.
+	if !fid.append && offset > math.MaxInt64-uint64(len(data)) {
+		return 0, Eoffset
+	}
+
+	// Charge the file's owner for any growth.
+	owner, size, err := u.quotaOwner(fid.path)
+	if err != nil {
+		return 0, err
+	}
+	end := int64(offset) + int64(len(data))
+	if fid.append {
+		end = size + int64(len(data))
+	}
+	var grow int64
+	if end > size {
+		grow = end - size
+	}
+	err = u.chargeQuota(owner, grow)
+	if err != nil {
+		return 0, err
 	}
 
-	e := os.Remove(fid.path)
+	// The offset is ignored for append-only files and OAPPEND.
+	var n int
+	var e error
+	if fid.append {
+		n, e = fid.file.Write(data)
+	} else {
+		n, e = fid.file.WriteAt(data, int64(offset))
+	}
 	if e != nil {
-		req.RespondError(toError(e))
+		u.chargeQuota(owner, -grow)
+		return 0, toError(e)
+	}
+
+	// The data is written, so report it even if the muid can't be.
+	err = u.setMuid(fid.path, user.Name())
+	if err != nil {
+		u.logf("set muid %s: %v", fid.path, err)
+	}
+	fid.wrote = true
+
+	return n, nil
+}
+
+// Record uid as the last user to change the file at path.
+func (u *VuFs) setMuid(path, uid string) error {
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	store := u.store()
+	m, err := getMeta(store, path)
+	if err != nil || m.Muid == uid {
+		return err
+	}
+	m.Muid = uid
+	return store.Set(path, m)
+}
+
+func (u *VuFs) Clunk(req *srv.Req) {
+	fid, ok := req.Fid.Aux.(*Fid)
+	if ok && fid != nil {
+		err := u.clunk(fid, req.Fid.User)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	req.RespondRclunk()
+}
+
+// A file opened with ORCLOSE is removed when its fid is clunked.
+// The clunk succeeds even if the remove fails.
+func (u *VuFs) clunk(fid *Fid, user p.User) error {
+	if !u.clunkFid(fid) {
+		return srv.Eunknownfid
+	}
+	// Edits to the users file take effect once the writer is done.
+	if fid.wrote && u.isUsersFile(fid.path) {
+		err := u.ReloadUsers()
+		if err != nil {
+			u.logf("reload %s: %v", usersFile, err)
+		}
+	}
+	if fid.rclose {
+		fid.rclose = false
+		err := u.remove(fid.path, user)
+		if err != nil {
+			u.chatf("remove on clunk of %s: %v", fid.path, err)
+		}
+	}
+	return nil
+}
+
+func (u *VuFs) Remove(req *srv.Req) {
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	if !u.clunkFid(fid) {
+		req.RespondError(srv.Eunknownfid)
+		return
+	}
+
+	err := u.removeFid(fid, req.Fid.User)
+	if err != nil {
+		req.RespondError(err)
 		return
 	}
 
 	req.RespondRremove()
 }
 
-func (*VuFs) Stat(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
-	st, err := os.Stat(fid.path)
+// Remove the file a clunked fid refers to on behalf of user.
+func (u *VuFs) removeFid(fid *Fid, user p.User) error {
+	if fid.ctl != ctlNone {
+		return srv.Eperm
+	}
 
+	_, err := fid.stat()
 	if err != nil {
-		req.RespondError(toError(err))
+		return err
+	}
+
+	return u.remove(fid.path, user)
+}
+
+// Return the stat of an auth fid, which is owned by the user
+// authenticating and marked QTAUTH/DMAUTH.
+func authDir(afid *srv.Fid) *p.Dir {
+	dir := new(p.Dir)
+	dir.Qid.Type = p.QTAUTH
+	dir.Mode = p.DMAUTH | 0600
+	dir.Name = "auth"
+	if afid.User != nil {
+		dir.Uid = afid.User.Name()
+		dir.Gid = afid.User.Name()
+	}
+	dir.Muid = dir.Uid
+	return dir
+}
+
+func (u *VuFs) Stat(req *srv.Req) {
+	// Auth fids have no file behind them.
+	if req.Fid.Type&p.QTAUTH != 0 {
+		req.RespondRstat(authDir(req.Fid))
 		return
 	}
 
-	dir, err := dir2Dir(fid.path, st, req.Conn.Srv.Upool)
+	fid := req.Fid.Aux.(*Fid)
+	dir, err := u.stat(fid)
 	if err != nil {
 		req.RespondError(err)
 		return
 	}
+	if statSize(dir, req.Conn.Dotu) > statMax {
+		req.RespondError(Estattoolarge)
+		return
+	}
 	req.RespondRstat(dir)
 }
 
+// Return the stat of the file fid refers to.
+func (u *VuFs) stat(fid *Fid) (*p.Dir, error) {
+	u.tree.RLock()
+	defer u.tree.RUnlock()
+
+	if fid.ctl != ctlNone {
+		return ctlStat(fid.ctl), nil
+	}
+
+	st, err := fid.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return u.dir2Dir(fid.path, st)
+}
+
 func (u *VuFs) Wstat(req *srv.Req) {
-	fid := req.Fid.Aux.(*Fid)
-	_, err := os.Stat(fid.path)
+	u.tree.Lock()
+	defer u.tree.Unlock()
+
+	fid, ok := req.Fid.Aux.(*Fid)
+	if !ok || fid == nil || fid.ctl != ctlNone {
+		req.RespondError(srv.Eperm)
+		return
+	}
+	st, err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+	f, err := dir2Dir(fid.path, st, u.store())
 	if err != nil {
 		req.RespondError(toError(err))
 		return
 	}
 
 	dir := &req.Tc.Dir
+
+	// A wstat that changes nothing asks for the file to be synced
+	// to disk, which is allowed even when read-only.
+	if u.isReadOnly() && !wstatNop(dir) {
+		req.RespondError(Erofs)
+		return
+	}
+
+	// Only the owner or a user with write permission may change times.
+	if dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
+		if f.Uid != req.Fid.User.Name() && !CheckPerm(f, req.Fid.User, p.DMWRITE) {
+			req.RespondError(srv.Eperm)
+			return
+		}
+	}
+
+	// Only its owner may change the users file in any way.
+	users := u.isUsersFile(fid.path)
+	if users && !wstatNop(dir) && f.Uid != req.Fid.User.Name() {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	// A rename may neither take the users file away nor replace
+	// it, and never replaces another file.
+	var newname string
+	if dir.Name != "" {
+		err = validFilename(dir.Name)
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+		newname = path.Join(path.Dir(fid.path), dir.Name)
+		if newname == fid.path {
+			newname = ""
+		}
+	}
+	if newname != "" {
+		err = u.checkUsersFile(fid.path, req.Fid.User)
+		if err == nil {
+			err = u.checkUsersFile(newname, req.Fid.User)
+		}
+		if err == nil {
+			_, err = os.Lstat(newname)
+			if err == nil {
+				err = srv.Eexist
+			} else if os.IsNotExist(err) {
+				err = nil
+			} else {
+				err = osError(err)
+			}
+		}
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	if dir.Length != 0xFFFFFFFFFFFFFFFF && u.gzipped(fid.path) {
+		req.RespondError(Ecompressed)
+		return
+	}
+
 	if dir.Mode != 0xFFFFFFFF {
 		mode := dir.Mode & 0777
 		e := os.Chmod(fid.path, os.FileMode(mode))
@@ -731,21 +2018,24 @@ func (u *VuFs) Wstat(req *srv.Req) {
 		}
 	}
 */
-	if dir.Name != "" {
-		// If we path.Join dir.Name to / before adding it to
-		// the fid path, that ensures nobody gets to walk out of the
-		// root of this server.
-		newname := path.Join(path.Dir(fid.path), path.Join("/", dir.Name))
-
-		// absolute renaming. VuFs can do this, so let's support it.
-		// We'll allow an absolute path in the Name and, if it is,
-		// we will make it relative to root. This is a gigantic performance
-		// improvement in systems that allow it.
-		if filepath.IsAbs(dir.Name) {
-			newname = path.Join(fid.path, dir.Name)
+	if newname != "" {
+		// The name was checked above, so the file stays in
+		// its directory.
+		err := syscall.Rename(fid.path, newname)
+		if err != nil {
+			req.RespondError(toError(err))
+			return
 		}
 
-		err := syscall.Rename(fid.path, newname)
+		// The metadata moves with the file.
+		store := u.store()
+		m, ok, err := store.Get(fid.path)
+		if err == nil && ok {
+			err = store.Delete(fid.path)
+			if err == nil {
+				err = store.Set(newname, m)
+			}
+		}
 		if err != nil {
 			req.RespondError(toError(err))
 			return
@@ -754,11 +2044,28 @@ func (u *VuFs) Wstat(req *srv.Req) {
 	}
 
 	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		owner, size, err := u.quotaOwner(fid.path)
+		if err == nil {
+			err = u.chargeQuota(owner, int64(dir.Length)-size)
+		}
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
 		e := os.Truncate(fid.path, int64(dir.Length))
 		if e != nil {
+			u.chargeQuota(owner, size-int64(dir.Length))
 			req.RespondError(toError(e))
 			return
 		}
+
+		// As when a write changes it.
+		if users {
+			err = u.ReloadUsers()
+			if err != nil {
+				u.logf("reload %s: %v", usersFile, err)
+			}
+		}
 	}
 
 	// If either mtime or atime need to be changed, then
@@ -788,6 +2095,20 @@ func (u *VuFs) Wstat(req *srv.Req) {
 	req.RespondRwstat()
 }
 
-func New(root string) *VuFs {
-	return &VuFs{Root: root}
+// Report whether a wstat leaves every field unchanged.
+func wstatNop(dir *p.Dir) bool {
+	return dir.Mode == 0xFFFFFFFF && dir.Length == 0xFFFFFFFFFFFFFFFF &&
+		dir.Mtime == ^uint32(0) && dir.Atime == ^uint32(0) &&
+		dir.Name == "" && dir.Uid == "" && dir.Gid == "" && dir.Muid == ""
+}
+
+// Return a file system serving the tree at root, set up by opts.
+// Clients that ask for 9P2000.u get it.
+func New(root string, opts ...Option) *VuFs {
+	u := &VuFs{Root: root}
+	u.Dotu = true
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
 }
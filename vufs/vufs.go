@@ -10,31 +10,72 @@ import (
 	"github.com/mbucc/vufs"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
-var addr = flag.String("addr", ":5640", "network address")
+var network = flag.String("net", "tcp", "network type (tcp or unix)")
+var addr = flag.String("addr", ":5640", "network address (socket path for unix)")
 var debug = flag.Int("debug", 0, "print debug messages")
 var root = flag.String("root", "/", "root filesystem")
+var gzipSuffix = flag.String("gzip", "", "serve files with this suffix decompressed")
+var guest = flag.String("guest", "", "run unknown users as this user")
+var owner = flag.String("user", "adm", "owner of files with no owner recorded")
 
 func main() {
-	var err error
 	flag.Parse()
-	fs := new(vufs.VuFs)
-	fs.Id = "vufs"
-	fs.Root = *root
-	fs.Debuglevel = *debug
-	fs.Upool, err  = vufs.NewVusers(*root)
+	users, err := vufs.NewVusers(*root, *owner)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+	if *guest != "" && users.Uname2User(*guest) == nil {
+		log.Printf("-guest: no user named '%s'\n", *guest)
+		os.Exit(1)
+	}
+	fs := vufs.New(*root,
+		vufs.WithUsers(users),
+		vufs.WithDefaultUser(*owner),
+		vufs.WithGuest(*guest))
+	fs.Id = "vufs"
+	fs.Debuglevel = *debug
+	fs.GzipSuffix = *gzipSuffix
 
 	fs.Start(fs)
 
+	// One goroutine takes every signal, so a reload never runs
+	// during or after Stop.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go handleSignals(fs, sigs)
+
 	fmt.Print("vufs starting\n")
-	err = fs.StartNetListener("tcp", *addr)
+	err = fs.StartNetListener(*network, *addr)
+	if err == vufs.Estopped {
+		// Stop closes the listener first; let it finish the
+		// requests in flight before exiting.
+		fs.Wait()
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 }
+
+// Reload adm/users on SIGHUP; stop serving on any other signal.
+func handleSignals(fs *vufs.VuFs, sigs <-chan os.Signal) {
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("%v: stopping\n", sig)
+			fs.Stop()
+			return
+		}
+		err := fs.ReloadUsers()
+		if err != nil {
+			log.Printf("reload users: %v\n", err)
+		} else {
+			log.Println("reloaded users")
+		}
+	}
+}
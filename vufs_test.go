@@ -6,14 +6,24 @@ package vufs
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"9fans.net/go/plan9"
 	"9fans.net/go/plan9/client"
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
 )
 
 import "fmt"
@@ -84,6 +94,35 @@ func BenchmarkOsOpenClose(b *testing.B) {
 	}
 }
 
+// Reads of one file from several connections at once.  Requests
+// are handled concurrently, so on a multi-core machine this should
+// scale with GOMAXPROCS (compare -cpu 1,4).
+func BenchmarkConcurrentReads(b *testing.B) {
+
+	runserver(rootdir, port)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := client.Dial("tcp", port)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		fsys, err := conn.Attach(nil, "adm", "/")
+		if err != nil {
+			b.Fatal(err)
+		}
+		fid, err := fsys.Open("/moe-moe.txt", plan9.OREAD)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer fid.Close()
+		buf := make([]byte, 100)
+		for pb.Next() {
+			fid.ReadAt(buf, 0)
+		}
+	})
+}
+
 // 0.06 milliseconds.
 func BenchmarkReadDir(b *testing.B) {
 
@@ -96,6 +135,45 @@ func BenchmarkReadDir(b *testing.B) {
 	}
 }
 
+// Reading a directory from the start packs its entries again, since
+// they include the stat of every file in it, which can change
+// without the directory's version changing.  Reads after the first
+// copy from what the fid packed.
+func BenchmarkReadBigDir(b *testing.B) {
+
+	conn := runserver(rootdir, port)
+	dir := rootdir + "/big"
+	os.Mkdir(dir, 0755)
+	for i := 0; i < 1000; i++ {
+		ioutil.WriteFile(fmt.Sprintf("%s/%04d", dir, i), nil, 0644)
+	}
+	fsys, _ := conn.Attach(nil, "adm", "/")
+	fid, _ := fsys.Open("/big", plan9.OREAD)
+	defer fid.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fid.Seek(0, 0)
+		fid.Dirreadall()
+	}
+}
+
+// 0.13 milliseconds.  go9p reuses a connection's reply Fcalls, but
+// only once the reply has been written, so a client that waits for
+// each reply often gets a newly allocated msize buffer.
+func BenchmarkRead(b *testing.B) {
+
+	conn := runserver(rootdir, port)
+	fsys, _ := conn.Attach(nil, "adm", "/")
+	fid, _ := fsys.Open("/moe-moe.txt", plan9.OREAD)
+	defer fid.Close()
+	buf := make([]byte, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fid.ReadAt(buf, 0)
+	}
+}
+
 var initialFiles = map[string]initialFile{
 	"/":     {"/", ".uidgid, adm, larry-moe.txt, moe-moe.txt", 0775},
 	"/adm/": {"/adm/", "", 0775},
@@ -175,20 +253,38 @@ func initfs(rootdir string) {
 var testserver net.Listener
 var started bool
 
-func runserver(rootdir, port string) *client.Conn {
+// Create a file system on a freshly initialized rootdir.
+func newfs(rootdir string) *VuFs {
 
 	initfs(rootdir)
 
 	var err error
 	fs := New(rootdir)
 	fs.Id = "vufs"
-	fs.Upool, err = NewVusers(rootdir)
+	fs.Upool, err = NewVusers(rootdir, "")
 	if err != nil {
 		panic(err)
 	}
+
+	return fs
+}
+
+func runserver(rootdir, port string) *client.Conn {
+	return runserverWith(rootdir, port, nil)
+}
+
+// Like runserver, but config (if not nil) can set options on
+// the file system before it starts listening.
+func runserverWith(rootdir, port string, config func(*VuFs)) *client.Conn {
+
+	var err error
+	fs := newfs(rootdir)
 	//fs.Debuglevel = 1
 
 	fs.Start(fs)
+	if config != nil {
+		config(fs)
+	}
 
 	if started {
 		fmt.Println("stopping testserver")
@@ -327,7 +423,7 @@ func create(conn *client.Conn, username, filepath string, mode os.FileMode) erro
 }
 
 // Delete file or directory
-func delete(conn *client.Conn, username, filepath string) error {
+func remove(conn *client.Conn, username, filepath string) error {
 
 	fsys, err := conn.Attach(nil, username, "/")
 
@@ -363,6 +459,87 @@ func usergroup(conn *client.Conn, filepath, user string) (string, string, error)
 	return dir.Uid, dir.Gid, nil
 }
 
+// A connection that speaks 9P without a client library, for
+// exchanges the client won't produce.
+type rawConn struct {
+	net.Conn
+	msize uint32
+	dotu  bool
+}
+
+// Dial the test server and negotiate msize.
+func dialRaw(msize uint32) (*rawConn, error) {
+	return dialRawVersion(msize, "9P2000")
+}
+
+// Dial the test server and negotiate msize and version.
+func dialRawVersion(msize uint32, version string) (*rawConn, error) {
+
+	c, err := net.Dial("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	rc := &rawConn{c, msize, false}
+
+	tx := p.NewFcall(msize)
+	p.PackTversion(tx, msize, version)
+	rx, err := rc.rpc(tx, p.NOTAG)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if rx.Type != p.Rversion {
+		c.Close()
+		return nil, fmt.Errorf("version: %v", rx)
+	}
+	rc.msize = rx.Msize
+	rc.dotu = rx.Version == "9P2000.u"
+
+	return rc, nil
+}
+
+// Send tx with tag and return the reply.
+func (c *rawConn) rpc(tx *p.Fcall, tag uint16) (*p.Fcall, error) {
+
+	err := c.send(tx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.recv()
+}
+
+// Send tx with tag without waiting for the reply.
+func (c *rawConn) send(tx *p.Fcall, tag uint16) error {
+
+	p.SetTag(tx, tag)
+	_, err := c.Write(tx.Pkt)
+
+	return err
+}
+
+// Read the next reply.
+func (c *rawConn) recv() (*p.Fcall, error) {
+
+	buf := make([]byte, 4, c.msize)
+	_, err := io.ReadFull(c, buf)
+	if err != nil {
+		return nil, err
+	}
+	size, _ := p.Gint32(buf)
+	if size < 4 || size > c.msize {
+		return nil, fmt.Errorf("bad reply size %d", size)
+	}
+	buf = buf[:size]
+	_, err = io.ReadFull(c, buf[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	rx, err, _ := p.Unpack(buf, c.dotu)
+	return rx, err
+}
+
 func TestCreate(t *testing.T) {
 
 	conn := runserver(rootdir, port)
@@ -396,93 +573,3176 @@ func TestCreate(t *testing.T) {
 
 }
 
-func TestFiles(t *testing.T) {
+func TestWstatMtime(t *testing.T) {
 
 	conn := runserver(rootdir, port)
 
-	for _, tt := range optests {
+	var mtime uint32 = 1234567890
 
-		if !tt.keepState {
-			initfs(rootdir)
-		}
+	// Other users only have read permission on moe-moe.txt.
+	fsys, err := conn.Attach(nil, "curly", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	var d plan9.Dir
+	d.Null()
+	d.Mtime = mtime
+	err = fsys.Wstat("/moe-moe.txt", &d)
+	if err == nil {
+		t.Error("curly could change mtime of /moe-moe.txt")
+	}
 
-		switch tt.op {
+	fsys, err = conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	err = fsys.Wstat("/moe-moe.txt", &d)
+	if err != nil {
+		t.Fatalf("moe could not change mtime: %v\n", err)
+	}
 
-		default:
-			t.Errorf("Unsupported operation %s in optest = %s\n", tt.op, tt)
+	dir, err := fsys.Stat("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if dir.Mtime != mtime {
+		t.Errorf("wrong mtime, got %d, expected %d\n", dir.Mtime, mtime)
+	}
+}
 
-		case "delete":
-			err := delete(conn, tt.user, tt.path)
-			if tt.allowed {
-				if err != nil {
-					t.Errorf("%s: %v\n", tt, err)
-				}
-				fp, err := os.Open(rootdir + "/" + tt.path)
-				if err == nil {
-					fp.Close()
-					t.Errorf("%s: delete failed\n", tt)
-				} else if !os.IsNotExist(err) {
-					t.Errorf("%s: after delete, err != IsNotExist: %v\n", tt, err)
-				}
+func TestEffectivePerm(t *testing.T) {
 
-			} else {
-				if err == nil {
-					t.Errorf("%s: was allowed\n", tt)
-				}
-			}
+	fs := newfs(rootdir)
+	defer os.RemoveAll(rootdir)
 
-			// User should be user, group should come from directory.
+	for _, tt := range permtests {
 
-		case "write":
-			err := os.Chmod(rootdir+tt.path, tt.mode)
-			if err != nil {
-				t.Errorf("%+v: chmod failed: %v\n", tt, err)
-			}
+		err := os.Chmod(rootdir+tt.path, tt.mode)
+		if err != nil {
+			t.Errorf("%+v: chmod failed: %v\n", tt, err)
+		}
 
-			n, newcontents, err := write(conn, tt.user, tt.path, "whom")
-			if tt.allowed {
-				if err != nil {
-					t.Errorf("%s: %v\n", tt, err)
-				}
+		r, w, x, err := fs.EffectivePerm(tt.user, tt.path)
+		if err != nil {
+			t.Errorf("%+v: %v\n", tt, err)
+			continue
+		}
 
-				if n != 4 {
-					t.Errorf("%s: exp = 4, act = %d\n", tt, n)
-				}
+		if r != tt.read || w != tt.write || x != tt.exec {
+			t.Errorf("%+v: got read=%v, write=%v, exec=%v\n", tt, r, w, x)
+		}
+	}
 
-				if newcontents != "whomever" {
-					t.Errorf("%s: exp = 'whomever', act = '%s'\n", tt, newcontents)
-				}
+	_, _, _, err := fs.EffectivePerm("nobody", "/moe-moe.txt")
+	if err == nil {
+		t.Error("EffectivePerm succeeded for unknown user")
+	}
 
-			} else {
-				if err == nil {
-					t.Errorf("%s: was allowed\n", tt)
-				}
-			}
+	_, _, _, err = fs.EffectivePerm("moe", "/nosuchfile")
+	if err == nil {
+		t.Error("EffectivePerm succeeded for missing file")
+	}
+}
 
-		case "read":
-			err := os.Chmod(rootdir+tt.path, tt.mode)
-			if err != nil {
-				t.Errorf("%+v: chmod failed: %v\n", tt, err)
-			}
-			contents, err := read(conn, tt.user, tt.path)
-			if tt.allowed {
-				if err != nil {
-					t.Errorf("%s: %v\n", tt, err)
-				}
-				f, found := initialFiles[tt.path]
-				if !found {
-					t.Errorf("%s: not found in initialFiles\n", tt)
-				}
-				if contents != f.contents {
-					t.Errorf("%s: exp = '%s', act = '%s'\n", tt, f.contents, contents)
-				}
-			} else {
-				if err == nil {
-					t.Errorf("%s: was allowed\n", tt)
-				}
+func TestCanAccess(t *testing.T) {
+
+	fs := newfs(rootdir)
+	defer os.RemoveAll(rootdir)
+
+	for _, tt := range permtests {
+
+		err := os.Chmod(rootdir+tt.path, tt.mode)
+		if err != nil {
+			t.Errorf("%+v: chmod failed: %v\n", tt, err)
+		}
+
+		for _, c := range []struct {
+			perm uint32
+			ok   bool
+		}{
+			{p.DMREAD, tt.read},
+			{p.DMWRITE, tt.write},
+			{p.DMEXEC, tt.exec},
+			{p.DMREAD | p.DMWRITE, tt.read && tt.write},
+		} {
+			ok, err := fs.CanAccess(tt.user, tt.path, c.perm)
+			if err != nil || ok != c.ok {
+				t.Errorf("%+v: perm %#o: got %v, %v, expected %v\n", tt, c.perm, ok, err, c.ok)
 			}
 		}
 	}
+
+	// The user needs to be able to search the directories on the way.
+	err := os.Mkdir(rootdir+"/private", 0700)
+	if err == nil {
+		err = ioutil.WriteFile(rootdir+"/private/open.txt", []byte("x"), 0666)
+	}
+	if err == nil {
+		err = os.Chmod(rootdir+"/private/open.txt", 0666)
+	}
+	if err != nil {
+		t.Fatalf("setup: %v\n", err)
+	}
+	for _, tt := range []struct {
+		user string
+		ok   bool
+	}{
+		{"adm", true},
+		{"moe", false},
+	} {
+		ok, err := fs.CanAccess(tt.user, "/private/open.txt", p.DMREAD)
+		if err != nil || ok != tt.ok {
+			t.Errorf("%s read /private/open.txt: got %v, %v, expected %v\n", tt.user, ok, err, tt.ok)
+		}
+	}
+
+	// Nothing can be written when the tree is read-only.
+	fs.SetReadOnly(true)
+	if ok, err := fs.CanAccess("adm", "/private/open.txt", p.DMWRITE); err != nil || ok {
+		t.Errorf("read-only write: got %v, %v, expected false\n", ok, err)
+	}
+	fs.SetReadOnly(false)
+
+	if _, err = fs.CanAccess("moe", "/nosuchfile", p.DMREAD); err != ErrNotExist {
+		t.Errorf("missing file: got %v, expected %v\n", err, ErrNotExist)
+	}
+	if _, err = fs.CanAccess("moe", "/moe-moe.txt/x", p.DMREAD); err != Enotdir {
+		t.Errorf("walk through a file: got %v, expected %v\n", err, Enotdir)
+	}
+	if _, err = fs.CanAccess("nobody", "/moe-moe.txt", p.DMREAD); err != ErrNoUser {
+		t.Errorf("unknown user: got %v, expected %v\n", err, ErrNoUser)
+	}
+}
+
+func TestOpenTruncate(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	_, contents, err := write(conn, "moe", "/moe-moe.txt", "whom")
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	if contents == "" {
+		t.Fatal("write left file empty")
+	}
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/moe-moe.txt", plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatalf("open with OTRUNC: %v\n", err)
+	}
+	fid.Close()
+
+	data, err := ioutil.ReadFile(rootdir + "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if len(data) != 0 {
+		t.Errorf("file not truncated, contents = '%s'\n", data)
+	}
+
+	// Truncating requires write permission.
+	fsys, err = conn.Attach(nil, "curly", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err = fsys.Open("/larry-moe.txt", plan9.OREAD|plan9.OTRUNC)
+	if err == nil {
+		fid.Close()
+		t.Error("curly could truncate /larry-moe.txt")
+	}
+
+	// Directories cannot be truncated.
+	fsys, err = conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err = fsys.Open("/adm", plan9.OREAD|plan9.OTRUNC)
+	if err == nil {
+		fid.Close()
+		t.Error("adm could open /adm with OTRUNC")
+	}
+}
+
+func TestDiskChanges(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/moe-moe.txt", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	defer fid.Close()
+
+	// An open fid sees changes made on disk.
+	err = ioutil.WriteFile(rootdir+"/moe-moe.txt", []byte("reloaded"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	buf := make([]byte, 100)
+	n, err := fid.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		t.Fatalf("read: %v\n", err)
+	}
+	if string(buf[:n]) != "reloaded" {
+		t.Errorf("read '%s', expected 'reloaded'\n", buf[:n])
+	}
+
+	// Once the file is removed, the fid gets a clean error.
+	err = os.Remove(rootdir + "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("Remove: %v\n", err)
+	}
+	_, err = fid.ReadAt(buf, 0)
+	if err == nil || err.Error() != Eremoved.Err {
+		t.Errorf("read after remove: got %v, expected %v\n", err, Eremoved)
+	}
+	_, err = fid.Stat()
+	if err == nil || err.Error() != Eremoved.Err {
+		t.Errorf("stat after remove: got %v, expected %v\n", err, Eremoved)
+	}
+}
+
+func TestRemoveOnClunk(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	// Remove-on-close requires write permission in the parent.
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/moe-moe.txt", plan9.OREAD|plan9.ORCLOSE)
+	if err == nil {
+		fid.Close()
+		t.Error("moe could open /moe-moe.txt with ORCLOSE")
+	}
+	err = fsys.Remove("/moe-moe.txt")
+	if err == nil {
+		t.Error("moe could remove /moe-moe.txt")
+	}
+
+	fsys, err = conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err = fsys.Open("/moe-moe.txt", plan9.OREAD|plan9.ORCLOSE)
+	if err != nil {
+		t.Fatalf("open with ORCLOSE: %v\n", err)
+	}
+	fid.Close()
+
+	_, err = os.Stat(rootdir + "/moe-moe.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("file not removed on clunk, err = %v\n", err)
+	}
+	_, err = fsys.Stat("/moe-moe.txt")
+	if err == nil {
+		t.Error("file still visible after clunk")
+	}
+	data, err := ioutil.ReadFile(rootdir + "/" + uidgidFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if strings.Contains(string(data), "moe-moe.txt") {
+		t.Errorf("%s still lists moe-moe.txt: '%s'\n", uidgidFile, data)
+	}
+
+	// A file created with ORCLOSE is removed too.
+	fid, err = fsys.Create("/scratch", plan9.ORDWR|plan9.ORCLOSE, 0600)
+	if err != nil {
+		t.Fatalf("create with ORCLOSE: %v\n", err)
+	}
+	fid.Close()
+
+	_, err = os.Stat(rootdir + "/scratch")
+	if !os.IsNotExist(err) {
+		t.Errorf("created file not removed on clunk, err = %v\n", err)
+	}
+}
+
+func TestEmptyDir(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Create("/d", plan9.OREAD, plan9.DMDIR|0755)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	fid.Close()
+
+	fid, err = fsys.Open("/d", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	defer fid.Close()
+
+	buf := make([]byte, messageSizeInBytes)
+	n, err := fid.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatalf("read: %v\n", err)
+	}
+	if n != 0 {
+		t.Errorf("read %d bytes from empty directory\n", n)
+	}
+}
+
+func TestExclusiveUse(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Create("/excl", plan9.OWRITE, plan9.DMEXCL|0666)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	fid.Close()
+
+	d, err := fsys.Stat("/excl")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Mode&plan9.DMEXCL == 0 {
+		t.Errorf("DMEXCL not set in mode %o\n", d.Mode)
+	}
+
+	fid, err = fsys.Open("/excl", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("first open: %v\n", err)
+	}
+
+	conn2, err := client.Dial("tcp", port)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer conn2.Close()
+	fsys2, err := conn2.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid2, err := fsys2.Open("/excl", plan9.OREAD)
+	if err == nil {
+		fid2.Close()
+		t.Error("second open of DMEXCL file succeeded")
+	} else if err.Error() != Eexcl.Err {
+		t.Errorf("second open: got '%v', expected '%s'\n", err, Eexcl.Err)
+	}
+
+	// Clunking the first fid releases the file.
+	fid.Close()
+	fid2, err = fsys2.Open("/excl", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open after clunk: %v\n", err)
+	}
+	fid2.Close()
+}
+
+func TestGzip(t *testing.T) {
+
+	contents := strings.Repeat("compress me ", 100)
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.GzipSuffix = ".gz"
+		fs.MaxGunzip = int64(len(contents))
+	})
+
+	for _, tt := range []struct{ name, contents string }{
+		{"/page.html.gz", contents},
+		{"/big.html.gz", contents + "!"},
+	} {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(tt.contents))
+		zw.Close()
+		err := ioutil.WriteFile(rootdir+tt.name, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+
+	d, err := fsys.Stat("/page.html.gz")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Length != uint64(len(contents)) {
+		t.Errorf("stat length = %d, expected %d\n", d.Length, len(contents))
+	}
+
+	fid, err := fsys.Open("/page.html.gz", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	data, err := ioutil.ReadAll(fid)
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if string(data) != contents {
+		t.Errorf("read '%s', expected '%s'\n", data, contents)
+	}
+
+	// Nor can one larger than MaxGunzip be opened.
+	fid, err = fsys.Open("/big.html.gz", plan9.OREAD)
+	if err == nil {
+		fid.Close()
+		t.Error("opened a file larger than MaxGunzip")
+	} else if err.Error() != Egziptoolarge.Err {
+		t.Errorf("open big file: got %v, expected %v\n", err, Egziptoolarge.Err)
+	}
+
+	// An empty file, as one being written is, has length 0 and
+	// doesn't stop the directory being listed.
+	err = ioutil.WriteFile(rootdir+"/empty.html.gz", nil, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	d, err = fsys.Stat("/empty.html.gz")
+	if err != nil {
+		t.Fatalf("stat empty file: %v\n", err)
+	}
+	if d.Length != 0 {
+		t.Errorf("empty file length = %d, expected 0\n", d.Length)
+	}
+	fid, err = fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open /: %v\n", err)
+	}
+	dirs, err := fid.Dirreadall()
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read /: %v\n", err)
+	}
+	found := 0
+	for _, d := range dirs {
+		if d.Name == "empty.html.gz" || d.Name == "page.html.gz" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("found %d of the gzip files in /, expected 2\n", found)
+	}
+
+	// Compressed files cannot be written.
+	fsys, err = conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err = fsys.Open("/page.html.gz", plan9.OWRITE)
+	if err == nil {
+		fid.Close()
+		t.Error("opened compressed file for writing")
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Create("/log", plan9.OWRITE, plan9.DMAPPEND|0666)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	for _, s := range []string{"a", "b"} {
+		_, err = fid.WriteAt([]byte(s), 0)
+		if err != nil {
+			t.Fatalf("write %s: %v\n", s, err)
+		}
+	}
+	fid.Close()
+
+	// Reopening with OTRUNC does not truncate, and writes still append.
+	fid, err = fsys.Open("/log", plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	_, err = fid.WriteAt([]byte("c"), 0)
+	if err != nil {
+		t.Fatalf("write c: %v\n", err)
+	}
+	fid.Close()
+
+	data, err := ioutil.ReadFile(rootdir + "/log")
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if string(data) != "abc" {
+		t.Errorf("contents = '%s', expected 'abc'\n", data)
+	}
+
+	d, err := fsys.Stat("/log")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Mode&plan9.DMAPPEND == 0 {
+		t.Errorf("DMAPPEND not set in mode %o\n", d.Mode)
+	}
+}
+
+func TestOpenAppend(t *testing.T) {
+
+	fs := newfs(rootdir)
+	moe := fs.Connect("moe")
+
+	// OAPPEND writes go to the end whatever the offset; a plain
+	// open of the same file writes where it is told.
+	for _, tt := range []struct {
+		mode uint8
+		want string
+	}{
+		{p.OWRITE | p.OAPPEND, "whateverx"},
+		{p.OWRITE, "xhateverx"},
+		{p.ORDWR | p.OAPPEND | p.OTRUNC, "x"},
+	} {
+		fid, err := moe.Walk("/moe-moe.txt")
+		if err != nil {
+			t.Fatalf("walk: %v\n", err)
+		}
+		if _, err = moe.Open(fid, tt.mode); err != nil {
+			t.Fatalf("open: %v\n", err)
+		}
+		_, err = moe.Write(fid, []byte("x"), 0)
+		moe.Clunk(fid)
+		if err != nil {
+			t.Fatalf("write: %v\n", err)
+		}
+		data, err := ioutil.ReadFile(rootdir + "/moe-moe.txt")
+		if err != nil {
+			t.Fatalf("ReadFile: %v\n", err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("mode %#x: contents = '%s', expected '%s'\n", tt.mode, data, tt.want)
+		}
+	}
+
+	// The file itself does not become append-only.
+	fid, err := moe.Walk("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	d, err := moe.Stat(fid)
+	moe.Clunk(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Mode&p.DMAPPEND != 0 {
+		t.Errorf("DMAPPEND set in mode %o\n", d.Mode)
+	}
+}
+
+func TestWriteOffset(t *testing.T) {
+
+	runserver(rootdir, port)
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, false)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+	p.PackTwalk(tx, 1, 2, []string{"moe-moe.txt"})
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+		t.Fatalf("walk: %v %v\n", rx, err)
+	}
+	p.PackTopen(tx, 2, p.ORDWR)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Ropen {
+		t.Fatalf("open: %v %v\n", rx, err)
+	}
+
+	for _, offset := range []uint64{^uint64(0), ^uint64(0) - 10, 1<<63 - 1} {
+		p.PackTwrite(tx, 2, offset, 4, []byte("data"))
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rerror || rx.Error != Eoffset.Err {
+			t.Errorf("write at %#x: got %v %v, expected %v\n", offset, rx, err, Eoffset)
+		}
+
+		// Reading there finds the end of the file.
+		p.PackTread(tx, 2, offset, 4)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rread || rx.Count != 0 {
+			t.Errorf("read at %#x: got %v %v, expected 0 bytes\n", offset, rx, err)
+		}
+	}
+
+	// A directory offset past its entries is refused.
+	p.PackTwalk(tx, 1, 3, nil)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+		t.Fatalf("walk: %v %v\n", rx, err)
+	}
+	p.PackTopen(tx, 3, p.OREAD)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Ropen {
+		t.Fatalf("open: %v %v\n", rx, err)
+	}
+	p.PackTread(tx, 3, ^uint64(0), 4096)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rerror {
+		t.Errorf("directory read at %#x: got %v %v, expected an error\n", ^uint64(0), rx, err)
+	}
+
+	st, err := os.Stat(rootdir + "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if n := int64(len(initialFiles["/moe-moe.txt"].contents)); st.Size() != n {
+		t.Errorf("size %d, expected %d\n", st.Size(), n)
+	}
+}
+
+func TestReadWriteOnly(t *testing.T) {
+
+	var fs *VuFs
+	runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, false)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+	p.PackTwalk(tx, 1, 2, []string{"moe-moe.txt"})
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+		t.Fatalf("walk: %v %v\n", rx, err)
+	}
+	p.PackTopen(tx, 2, p.OWRITE)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Ropen {
+		t.Fatalf("open: %v %v\n", rx, err)
+	}
+	p.PackTread(tx, 2, 0, 100)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rerror || rx.Error != srv.Ebaduse.(*p.Error).Err {
+		t.Errorf("read of a write-only fid: got %v %v, expected %v\n", rx, err, srv.Ebaduse)
+	}
+
+	// So does a Session.
+	moe := fs.Connect("moe")
+	fid, err := moe.Walk("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer moe.Clunk(fid)
+	if _, err = moe.Open(fid, p.OWRITE); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	_, err = moe.Read(fid, make([]byte, 100), 0)
+	if err != srv.Ebaduse {
+		t.Errorf("Session read of a write-only fid: got %v, expected %v\n", err, srv.Ebaduse)
+	}
+}
+
+func TestDirLength(t *testing.T) {
+
+	fs := newfs(rootdir)
+	adm := fs.Connect("adm")
+
+	fid, err := adm.Walk("/")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	_, err = adm.Create(fid, "d", p.DMDIR|0775, p.OREAD)
+	adm.Clunk(fid)
+	if err != nil {
+		t.Fatalf("create: %v\n", err)
+	}
+	for i := 0; i < 100; i++ {
+		fid, err = adm.Walk("/d")
+		if err != nil {
+			t.Fatalf("walk: %v\n", err)
+		}
+		name := fmt.Sprintf("a-long-file-name-to-grow-the-directory-%d", i)
+		_, err = adm.Create(fid, name, 0664, p.OWRITE)
+		if err == nil {
+			_, err = adm.Write(fid, []byte("x"), 0)
+		}
+		adm.Clunk(fid)
+		if err != nil {
+			t.Fatalf("create %s: %v\n", name, err)
+		}
+	}
+
+	for _, path := range []string{"/", "/d"} {
+		fid, err = adm.Walk(path)
+		if err != nil {
+			t.Fatalf("walk: %v\n", err)
+		}
+		d, err := adm.Stat(fid)
+		adm.Clunk(fid)
+		if err != nil {
+			t.Fatalf("stat: %v\n", err)
+		}
+		if d.Length != 0 {
+			t.Errorf("%s has length %d, expected 0\n", path, d.Length)
+		}
+	}
+
+	// So do the entries read from a directory.
+	fid, err = adm.Walk("/")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer adm.Clunk(fid)
+	if _, err = adm.Open(fid, p.OREAD); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	buf := make([]byte, 8192)
+	n, err := adm.Read(fid, buf, 0)
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	for b := buf[:n]; len(b) > 0; {
+		d, rest, _, err := p.UnpackDir(b, false)
+		if err != nil {
+			t.Fatalf("UnpackDir: %v\n", err)
+		}
+		if d.Mode&p.DMDIR != 0 && d.Length != 0 {
+			t.Errorf("entry %s has length %d, expected 0\n", d.Name, d.Length)
+		}
+		b = rest
+	}
+}
+
+func TestFilterDirByPerm(t *testing.T) {
+
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.FilterDirByPerm(true)
+	})
+
+	err := os.Chmod(rootdir+"/adm", 0700)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+	err = os.Chmod(rootdir+"/moe-moe.txt", 0660)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+
+	// curly can read only larry-moe.txt.
+	fsys, err := conn.Attach(nil, "curly", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	names, err := readDir(fid)
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if string(names) != "larry-moe.txt" {
+		t.Errorf("curly sees '%s', expected 'larry-moe.txt'\n", names)
+	}
+
+	// moe can also read moe-moe.txt.
+	fsys, err = conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err = fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	d, err := fid.Dirreadall()
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if len(d) != 2 {
+		t.Errorf("moe sees %d entries, expected 2\n", len(d))
+	}
+}
+
+func TestAttachUnknownUser(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	_, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Errorf("attach as moe: %v\n", err)
+	}
+
+	_, err = conn.Attach(nil, "nobody", "/")
+	if err == nil {
+		t.Error("attach as unknown user succeeded")
+	} else if err.Error() != "unknown user" {
+		t.Errorf("attach as unknown user: got '%v', expected 'unknown user'\n", err)
+	}
+}
+
+func TestAttachGuest(t *testing.T) {
+
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		fs.Guest = "curly"
+	})
+
+	err := os.Chmod(rootdir+"/moe-moe.txt", 0660)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+
+	// Unknown users get the guest's permissions.
+	_, err = read(conn, "nobody", "/larry-moe.txt")
+	if err != nil {
+		t.Errorf("guest read /larry-moe.txt: %v\n", err)
+	}
+	_, err = read(conn, "nobody", "/moe-moe.txt")
+	if err == nil {
+		t.Error("guest read /moe-moe.txt")
+	}
+
+	// Known users are unaffected.
+	_, err = read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Errorf("moe read /moe-moe.txt: %v\n", err)
+	}
+}
+
+func TestLongFilename(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+
+	name := strings.Repeat("x", 300)
+	fid, err := fsys.Create("/"+name, plan9.OWRITE, 0644)
+	if err == nil {
+		fid.Close()
+		t.Fatal("created file with 300-byte name")
+	}
+	if err.Error() != Enametoolong.Err {
+		t.Errorf("create: got '%v', expected '%s'\n", err, Enametoolong.Err)
+	}
+
+	d := new(plan9.Dir)
+	d.Null()
+	d.Name = name
+	err = fsys.Wstat("/moe-moe.txt", d)
+	if err == nil {
+		t.Fatal("renamed file to 300-byte name")
+	}
+	if err.Error() != Enametoolong.Err {
+		t.Errorf("wstat: got '%v', expected '%s'\n", err, Enametoolong.Err)
+	}
+
+	for _, name := range []string{".", ".."} {
+		fid, err = fsys.Create("/"+name, plan9.OWRITE, 0644)
+		if err == nil {
+			fid.Close()
+			t.Errorf("created file named '%s'\n", name)
+		}
+	}
+}
+
+// Return the names in a buffer of packed directory entries.
+func unpackNames(b []byte) ([]string, error) {
+	var names []string
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("short entry")
+		}
+		size := int(b[0]) | int(b[1])<<8 + 2
+		if len(b) < size {
+			return nil, fmt.Errorf("short entry")
+		}
+		d, err := plan9.UnmarshalDir(b[:size])
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, d.Name)
+		b = b[size:]
+	}
+	return names, nil
+}
+
+func TestDirReadChunks(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	var expected []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		err := ioutil.WriteFile(rootdir+"/adm/"+name, nil, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+		expected = append(expected, name)
+	}
+	expected = append(expected, "users")
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/adm", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	defer fid.Close()
+
+	// Read in small chunks, each holding a whole number of entries.
+	var all []byte
+	buf := make([]byte, 128)
+	for {
+		n, err := fid.Read(buf)
+		if err != nil && err != io.EOF {
+			t.Fatalf("read at %d: %v\n", len(all), err)
+		}
+		if n == 0 {
+			break
+		}
+		all = append(all, buf[:n]...)
+	}
+
+	names, err := unpackNames(all)
+	if err != nil {
+		t.Fatalf("unpackNames: %v\n", err)
+	}
+
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("listing = %v, expected %v\n", names, expected)
+	}
+
+	// An offset inside an entry is rejected.
+	_, err = fid.ReadAt(buf, 3)
+	if err == nil {
+		t.Error("read at offset 3 succeeded")
+	}
+}
+
+func TestStatMax(t *testing.T) {
+
+	// A user whose name alone is longer than a stat can hold.
+	bigname := strings.Repeat("b", 70000)
+	conn := runserverWith(rootdir, port, func(fs *VuFs) {
+		users := initialFiles["/adm/users"].contents + "5:" + bigname + ":\n"
+		err := ioutil.WriteFile(rootdir+"/adm/users", []byte(users), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+		uidgid := initialFiles["/"+uidgidFile].contents + "big.txt:5:5\n"
+		err = ioutil.WriteFile(rootdir+"/"+uidgidFile, []byte(uidgid), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+		err = ioutil.WriteFile(rootdir+"/big.txt", nil, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+		fs.Upool, err = NewVusers(rootdir, "")
+		if err != nil {
+			t.Fatalf("NewVusers: %v\n", err)
+		}
+	})
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+
+	_, err = fsys.Stat("/big.txt")
+	if err == nil {
+		t.Error("stat of /big.txt succeeded")
+	} else if err.Error() != Estattoolarge.Err {
+		t.Errorf("stat: got '%v', expected '%s'\n", err, Estattoolarge.Err)
+	}
+
+	// The entry is left out of listings.
+	fid, err := fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	names, err := readDir(fid)
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if string(names) != initialFiles["/"].contents {
+		t.Errorf("listing = '%s', expected '%s'\n", names, initialFiles["/"].contents)
+	}
+}
+
+// Each request gets its own response Fcall, so concurrent requests
+// on one or many connections must not see each other's replies.
+// Run with -race.
+func TestConcurrentRequests(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("/adm/f%d", i)
+		err := ioutil.WriteFile(rootdir+name, []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	conn2, err := client.Dial("tcp", port)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer conn2.Close()
+
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		c := conn
+		if i%2 == 1 {
+			c = conn2
+		}
+		go func(c *client.Conn, name string) {
+			fsys, err := c.Attach(nil, "adm", "/")
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < 50; j++ {
+				fid, err := fsys.Open(name, plan9.OREAD)
+				if err != nil {
+					errs <- err
+					return
+				}
+				buf := make([]byte, 100)
+				n, err := fid.ReadAt(buf, 0)
+				fid.Close()
+				if err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if string(buf[:n]) != name {
+					errs <- fmt.Errorf("read '%s' from %s", buf[:n], name)
+					return
+				}
+				d, err := fsys.Stat(name)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if "/adm/"+d.Name != name {
+					errs <- fmt.Errorf("stat of %s returned %s", name, d.Name)
+					return
+				}
+			}
+			errs <- nil
+		}(c, fmt.Sprintf("/adm/f%d", i))
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDirReadSnapshot(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	for i := 0; i < 10; i++ {
+		err := ioutil.WriteFile(fmt.Sprintf("%s/adm/a%02d", rootdir, i), nil, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/adm", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	defer fid.Close()
+
+	readall := func(fid *client.Fid) []byte {
+		var all []byte
+		buf := make([]byte, 128)
+		for {
+			n, err := fid.Read(buf)
+			if err != nil && err != io.EOF {
+				t.Fatalf("read: %v\n", err)
+			}
+			if n == 0 {
+				return all
+			}
+			all = append(all, buf[:n]...)
+		}
+	}
+
+	// Read part of the directory, then change it on disk.
+	buf := make([]byte, 256)
+	n, err := fid.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	first := buf[:n]
+	for i := 0; i < 10; i++ {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/adm/%02d", rootdir, i), nil, 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+	}
+	err = os.Remove(rootdir + "/adm/a09")
+	if err != nil {
+		t.Fatalf("Remove: %v\n", err)
+	}
+
+	// The rest of the read comes from the listing taken at offset zero.
+	names, err := unpackNames(append(first, readall(fid)...))
+	if err != nil {
+		t.Fatalf("unpackNames: %v\n", err)
+	}
+	got := strings.Join(names, " ")
+	expected := "a00 a01 a02 a03 a04 a05 a06 a07 a08 a09 users"
+	if got != expected {
+		t.Errorf("listing = '%s', expected '%s'\n", got, expected)
+	}
+
+	// A new fid starts from a fresh listing.
+	fid2, err := fsys.Open("/adm", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	defer fid2.Close()
+	names, err = unpackNames(readall(fid2))
+	if err != nil {
+		t.Fatalf("unpackNames: %v\n", err)
+	}
+	if len(names) != 20 || names[0] != "00" {
+		t.Errorf("fresh listing = %v\n", names)
+	}
+}
+
+func TestSpecialFileModes(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	err := syscall.Mkfifo(rootdir+"/fifo", 0644)
+	if err != nil {
+		t.Fatalf("Mkfifo: %v\n", err)
+	}
+	l, err := net.Listen("unix", rootdir+"/sock")
+	if err != nil {
+		t.Fatalf("Listen: %v\n", err)
+	}
+	defer l.Close()
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		bit  plan9.Perm
+	}{
+		{"/fifo", plan9.DMNAMEDPIPE},
+		{"/sock", plan9.DMSOCKET},
+	} {
+		d, err := fsys.Stat(tt.path)
+		if err != nil {
+			t.Errorf("stat %s: %v\n", tt.path, err)
+			continue
+		}
+		if d.Mode&tt.bit == 0 {
+			t.Errorf("%s: mode %o missing %o\n", tt.path, d.Mode, tt.bit)
+		}
+	}
+
+	d, err := fsys.Stat("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Mode&(plan9.DMNAMEDPIPE|plan9.DMSOCKET|plan9.DMDEVICE) != 0 {
+		t.Errorf("regular file has mode %o\n", d.Mode)
+	}
+}
+
+func TestReadGrowingFile(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	r, err := fsys.Open("/moe-moe.txt", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if string(data) != "whatever" {
+		t.Fatalf("read '%s', expected 'whatever'\n", data)
+	}
+
+	// Append through another fid; the reader picks up where it left off.
+	w, err := fsys.Open("/moe-moe.txt", plan9.OWRITE)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	_, err = w.WriteAt([]byte(" next"), int64(len(data)))
+	w.Close()
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+
+	more, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if string(more) != " next" {
+		t.Errorf("read '%s' after append, expected ' next'\n", more)
+	}
+}
+
+func TestReadMsize(t *testing.T) {
+
+	runserver(rootdir, port)
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	err := ioutil.WriteFile(rootdir+"/big.txt", contents, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+
+	// Two connections with different msizes read the same file,
+	// each asking for more than its msize allows.
+	var conns []*rawConn
+	for _, msize := range []uint32{1024, 4096} {
+		c, err := dialRaw(msize)
+		if err != nil {
+			t.Fatalf("dial: %v\n", err)
+		}
+		defer c.Close()
+		if c.msize != msize {
+			t.Fatalf("negotiated msize %d, expected %d\n", c.msize, msize)
+		}
+
+		tx := p.NewFcall(c.msize)
+		p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rattach {
+			t.Fatalf("attach: %v %v\n", rx, err)
+		}
+		p.PackTwalk(tx, 1, 2, []string{"big.txt"})
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk: %v %v\n", rx, err)
+		}
+		p.PackTopen(tx, 2, p.OREAD)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Ropen {
+			t.Fatalf("open: %v %v\n", rx, err)
+		}
+		conns = append(conns, c)
+	}
+
+	for _, c := range conns {
+		tx := p.NewFcall(c.msize)
+		p.PackTread(tx, 2, 16, 65536)
+		rx, err := c.rpc(tx, 1)
+		if err != nil {
+			t.Fatalf("msize %d: read: %v\n", c.msize, err)
+		}
+		if rx.Type != p.Rread {
+			t.Fatalf("msize %d: read: %v\n", c.msize, rx)
+		}
+		if want := c.msize - p.IOHDRSZ; rx.Count != want {
+			t.Errorf("msize %d: read %d bytes, expected %d\n", c.msize, rx.Count, want)
+		}
+		if !bytes.Equal(rx.Data, contents[16:16+rx.Count]) {
+			t.Errorf("msize %d: read wrong data\n", c.msize)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	err := fs.SetMeta("/moe-moe.txt", ContentType, "text/plain")
+	if err != nil {
+		t.Fatalf("SetMeta: %v\n", err)
+	}
+
+	// larry can read moe-moe.txt but not write to /.
+	_, err = fs.Copy("larry", "/moe-moe.txt", "/copy.txt")
+	if err != srv.Eperm {
+		t.Errorf("larry copy: got %v, expected %v\n", err, srv.Eperm)
+	}
+
+	qid, err := fs.Copy("adm", "/moe-moe.txt", "/copy.txt")
+	if err != nil {
+		t.Fatalf("adm copy: %v\n", err)
+	}
+
+	contents, err := read(conn, "adm", "/copy.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if contents != initialFiles["/moe-moe.txt"].contents {
+		t.Errorf("copy contains '%s', expected '%s'\n", contents, initialFiles["/moe-moe.txt"].contents)
+	}
+
+	fsys, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	d, err := fsys.Stat("/copy.txt")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Uid != "adm" || d.Gid != "adm" {
+		t.Errorf("copy is %s:%s, expected adm:adm\n", d.Uid, d.Gid)
+	}
+	sd, err := fsys.Stat("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Mode&0777 != sd.Mode&0777 {
+		t.Errorf("copy mode = %o, expected %o\n", d.Mode&0777, sd.Mode&0777)
+	}
+	if d.Qid.Path != qid.Path {
+		t.Errorf("copy qid path = %d, Copy returned %d\n", d.Qid.Path, qid.Path)
+	}
+	meta, err := fs.Meta("/copy.txt")
+	if err != nil {
+		t.Fatalf("Meta: %v\n", err)
+	}
+	if meta[ContentType] != "text/plain" {
+		t.Errorf("copy content type = '%s'\n", meta[ContentType])
+	}
+
+	// The source is unchanged and the copy is not overwritten.
+	uid, gid, err := usergroup(conn, "/moe-moe.txt", "adm")
+	if err != nil {
+		t.Fatalf("usergroup: %v\n", err)
+	}
+	if uid != "moe" || gid != "moe" {
+		t.Errorf("source is %s:%s, expected moe:moe\n", uid, gid)
+	}
+	_, err = fs.Copy("adm", "/larry-moe.txt", "/copy.txt")
+	if err == nil {
+		t.Error("copy overwrote an existing file")
+	}
+	_, err = fs.Copy("adm", "/adm", "/adm2")
+	if err == nil {
+		t.Error("copied a directory")
+	}
+
+	// Paths are found as a walk would find them.  moe may write to
+	// /pub, but can't search /private, follow a link out of the
+	// tree or read adm's users file, whatever their modes.
+	for _, dir := range []string{"/pub", "/private"} {
+		if err = os.Mkdir(rootdir+dir, 0777); err != nil {
+			t.Fatalf("mkdir: %v\n", err)
+		}
+	}
+	err = ioutil.WriteFile(rootdir+"/private/open.txt", []byte("x"), 0666)
+	if err == nil {
+		err = os.Chmod(rootdir+"/pub", 0777)
+	}
+	if err == nil {
+		err = os.Chmod(rootdir+"/private", 0700)
+	}
+	if err == nil {
+		err = os.Chmod(rootdir+"/private/open.txt", 0666)
+	}
+	if err == nil {
+		err = os.Chmod(rootdir+"/"+usersFile, 0644)
+	}
+	if err == nil {
+		err = os.Symlink("/etc", rootdir+"/etc")
+	}
+	if err != nil {
+		t.Fatalf("setup: %v\n", err)
+	}
+	for _, src := range []string{"/private/open.txt", "/etc/passwd", "/" + usersFile} {
+		if _, err = fs.Copy("moe", src, "/pub/copy"); err != ErrPerm {
+			t.Errorf("moe copy %s: got %v, expected %v\n", src, err, ErrPerm)
+		}
+	}
+	if _, err = fs.Copy("adm", "/moe-moe.txt", "/etc/copy"); err != ErrPerm {
+		t.Errorf("adm copy into /etc: got %v, expected %v\n", err, ErrPerm)
+	}
+	if _, err = fs.Copy("moe", "/moe-moe.txt", "/pub/copy"); err != nil {
+		t.Errorf("moe copy to /pub: %v\n", err)
+	}
+}
+
+// A VuFs that holds a Tclunk and Tremove until both have their
+// fid, then runs the remove first, and that counts fids destroyed.
+type clunkRemoveFs struct {
+	*VuFs
+	clunking, removing chan bool
+	destroyed          int32
+}
+
+func (fs *clunkRemoveFs) Clunk(req *srv.Req) {
+	close(fs.clunking)
+	select {
+	case <-fs.removing:
+		time.Sleep(50 * time.Millisecond)
+	case <-time.After(time.Second):
+	}
+	fs.VuFs.Clunk(req)
+}
+
+func (fs *clunkRemoveFs) Remove(req *srv.Req) {
+	close(fs.removing)
+	select {
+	case <-fs.clunking:
+	case <-time.After(time.Second):
+	}
+	fs.VuFs.Remove(req)
+}
+
+func (fs *clunkRemoveFs) FidDestroy(fid *srv.Fid) {
+	atomic.AddInt32(&fs.destroyed, 1)
+	fs.VuFs.FidDestroy(fid)
+}
+
+func TestErrors(t *testing.T) {
+
+	var fs *VuFs
+	runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	for _, tt := range []struct {
+		uname, src, dst string
+		want            error
+	}{
+		{"larry", "/moe-moe.txt", "/copy.txt", ErrPerm},
+		{"moe", "/missing.txt", "/copy.txt", ErrNotExist},
+		{"adm", "/moe-moe.txt", "/moe-moe.txt", ErrExist},
+		{"nobody", "/moe-moe.txt", "/copy.txt", ErrNoUser},
+	} {
+		_, err := fs.Copy(tt.uname, tt.src, tt.dst)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s copy %s: got %v, expected %v\n", tt.uname, tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestClunkAndRemove(t *testing.T) {
+
+	var fs *clunkRemoveFs
+	runserverWith(rootdir, port, func(v *VuFs) {
+		fs = &clunkRemoveFs{VuFs: v, clunking: make(chan bool), removing: make(chan bool)}
+		v.Start(fs)
+	})
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+	p.PackTwalk(tx, 1, 2, []string{"moe-moe.txt"})
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rwalk {
+		t.Fatalf("walk: %v %v\n", rx, err)
+	}
+
+	// Send both before reading either reply.  The remove clunks
+	// the fid (though it fails, as moe cannot remove the file), so
+	// the clunk finds the fid gone.
+	p.PackTclunk(tx, 2)
+	c.send(tx, 2)
+	p.PackTremove(tx, 2)
+	c.send(tx, 3)
+
+	replies := make(map[uint16]*p.Fcall)
+	for i := 0; i < 2; i++ {
+		rx, err = c.recv()
+		if err != nil {
+			t.Fatalf("recv: %v\n", err)
+		}
+		replies[rx.Tag] = rx
+	}
+	if rx := replies[3]; rx == nil || rx.Type != p.Rerror || rx.Error != srv.Eperm.(*p.Error).Err {
+		t.Errorf("remove: got %v, expected %v\n", rx, srv.Eperm)
+	}
+	if rx := replies[2]; rx == nil || rx.Type != p.Rerror || rx.Error != srv.Eunknownfid.(*p.Error).Err {
+		t.Errorf("clunk: got %v, expected %v\n", rx, srv.Eunknownfid)
+	}
+	if n := atomic.LoadInt32(&fs.destroyed); n != 1 {
+		t.Errorf("fid destroyed %d times\n", n)
+	}
+
+	// The fid can be reused and the attach fid is untouched.
+	p.PackTwalk(tx, 1, 2, nil)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rwalk {
+		t.Errorf("reuse fid: %v %v\n", rx, err)
+	}
+}
+
+func TestMaxFids(t *testing.T) {
+
+	runserverWith(rootdir, port, func(fs *VuFs) { fs.MaxFids = 5 })
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+	for fid := uint32(2); fid <= 5; fid++ {
+		p.PackTwalk(tx, 1, fid, []string{"moe-moe.txt"})
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk to fid %d: %v %v\n", fid, rx, err)
+		}
+	}
+
+	// The sixth fid is refused, by walk or attach.
+	p.PackTwalk(tx, 1, 6, nil)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rerror || rx.Error != Etoomanyfids.Err {
+		t.Errorf("walk to fid 6: got %v %v, expected %v\n", rx, err, Etoomanyfids)
+	}
+	p.PackTattach(tx, 6, p.NOFID, "moe", "/", p.NOUID, false)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rerror || rx.Error != Etoomanyfids.Err {
+		t.Errorf("attach fid 6: got %v %v, expected %v\n", rx, err, Etoomanyfids)
+	}
+
+	// Existing fids still work.
+	p.PackTopen(tx, 5, p.OREAD)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Ropen {
+		t.Errorf("open fid 5: %v %v\n", rx, err)
+	}
+	p.PackTwalk(tx, 1, 1, nil)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rwalk {
+		t.Errorf("walk fid 1 to itself: %v %v\n", rx, err)
+	}
+
+	// Clunking one makes room for another.
+	p.PackTclunk(tx, 5)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rclunk {
+		t.Fatalf("clunk: %v %v\n", rx, err)
+	}
+	p.PackTwalk(tx, 1, 6, nil)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rwalk {
+		t.Errorf("walk to fid 6 after clunk: %v %v\n", rx, err)
+	}
+}
+
+func TestCtlGroups(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) {
+		fs = v
+		fs.Ctl = true
+	})
+	err := fs.SetUsers([]byte(initialFiles["/adm/users"].contents + "5:shemp:moe,larry\n"))
+	if err != nil {
+		t.Fatalf("SetUsers: %v\n", err)
+	}
+
+	for user, expected := range map[string]string{
+		"shemp": "moe\nlarry\n",
+		"moe":   "moe\n",
+	} {
+		contents, err := read(conn, user, "/ctl/groups")
+		if err != nil {
+			t.Fatalf("%s: read: %v\n", user, err)
+		}
+		if contents != expected {
+			t.Errorf("%s: groups = '%s', expected '%s'\n", user, contents, expected)
+		}
+	}
+
+	fsys, err := conn.Attach(nil, "shemp", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := fsys.Open("/ctl", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open /ctl: %v\n", err)
+	}
+	names, err := readDir(fid)
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read /ctl: %v\n", err)
+	}
+	if string(names) != "groups" {
+		t.Errorf("/ctl lists '%s', expected 'groups'\n", names)
+	}
+
+	// The files are read-only, and not listed in the root.
+	_, err = fsys.Open("/ctl/groups", plan9.OWRITE)
+	if err == nil {
+		t.Error("opened /ctl/groups for writing")
+	}
+	_, err = fsys.Create("/ctl/x", plan9.OWRITE, 0666)
+	if err == nil {
+		t.Error("created /ctl/x")
+	}
+	fid, err = fsys.Open("/", plan9.OREAD)
+	if err != nil {
+		t.Fatalf("open /: %v\n", err)
+	}
+	names, err = readDir(fid)
+	fid.Close()
+	if err != nil {
+		t.Fatalf("read /: %v\n", err)
+	}
+	if expected := initialFiles["/"].contents; string(names) != expected {
+		t.Errorf("/ lists '%s', expected '%s'\n", names, expected)
+	}
+}
+
+func TestStrictGroupInherit(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	// /shared is writable by all and in group moe.
+	err := os.Mkdir(rootdir+"/shared", 0777)
+	if err == nil {
+		err = os.Chmod(rootdir+"/shared", 0777)
+	}
+	if err != nil {
+		t.Fatalf("Mkdir: %v\n", err)
+	}
+	uidgid := initialFiles["/"+uidgidFile].contents + "shared:1:3\n"
+	err = ioutil.WriteFile(rootdir+"/"+uidgidFile, []byte(uidgid), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+
+	for _, tt := range []struct {
+		strict     bool
+		user, file string
+		group      string
+	}{
+		{false, "larry", "/shared/a", "moe"},
+		{true, "moe", "/shared/b", "moe"},
+		{true, "larry", "/shared/c", "larry"},
+	} {
+		fs.StrictGroupInherit(tt.strict)
+		err = create(conn, tt.user, tt.file, 0644)
+		if err != nil {
+			t.Fatalf("%s create %s: %v\n", tt.user, tt.file, err)
+		}
+		uid, gid, err := usergroup(conn, tt.file, tt.user)
+		if err != nil {
+			t.Fatalf("usergroup: %v\n", err)
+		}
+		if uid != tt.user || gid != tt.group {
+			t.Errorf("strict=%v: %s is %s:%s, expected %s:%s\n",
+				tt.strict, tt.file, uid, gid, tt.user, tt.group)
+		}
+	}
+}
+
+// A bytes.Buffer that is safe to write from server goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogger(t *testing.T) {
+
+	var buf syncBuffer
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) {
+		fs = v
+		fs.Logger = log.New(&buf, "", 0)
+	})
+
+	// Quiet unless chatty.
+	_, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	if buf.String() != "" {
+		t.Errorf("logged '%s' with Debuglevel 0\n", buf.String())
+	}
+
+	// Keep a log of fcalls rather than printing them.
+	fs.Debuglevel = srv.DbgLogFcalls
+	_, err = conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	if !strings.Contains(buf.String(), "attach moe\n") {
+		t.Errorf("log = '%s', expected an attach line\n", buf.String())
+	}
+}
+
+func TestPing(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	// Healthy while serving.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			_, err := read(conn, "moe", "/moe-moe.txt")
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		if err := fs.Ping(); err != nil {
+			t.Errorf("Ping: %v\n", err)
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("read: %v\n", err)
+	}
+
+	// Not healthy without a root.
+	err := os.RemoveAll(rootdir)
+	if err != nil {
+		t.Fatalf("RemoveAll: %v\n", err)
+	}
+	if fs.Ping() == nil {
+		t.Error("Ping succeeded with no root directory")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) {
+		WithReadOnly()(v)
+		fs = v
+	})
+
+	contents, err := read(conn, "moe", "/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if contents != initialFiles["/moe-moe.txt"].contents {
+		t.Errorf("read '%s', expected '%s'\n", contents, initialFiles["/moe-moe.txt"].contents)
+	}
+
+	rofs := Erofs.Err
+	if err = create(conn, "adm", "/new.txt", 0644); err == nil || err.Error() != rofs {
+		t.Errorf("create: got %v, expected %s\n", err, rofs)
+	}
+	if _, _, err = write(conn, "moe", "/moe-moe.txt", "whom"); err == nil || err.Error() != rofs {
+		t.Errorf("write: got %v, expected %s\n", err, rofs)
+	}
+	if err = remove(conn, "adm", "/moe-moe.txt"); err == nil || err.Error() != rofs {
+		t.Errorf("remove: got %v, expected %s\n", err, rofs)
+	}
+
+	fsys, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	d := new(plan9.Dir)
+	d.Null()
+	d.Name = "renamed.txt"
+	if err = fsys.Wstat("/moe-moe.txt", d); err == nil || err.Error() != rofs {
+		t.Errorf("rename: got %v, expected %s\n", err, rofs)
+	}
+
+	// A wstat that changes nothing is a sync.
+	d.Null()
+	if err = fsys.Wstat("/moe-moe.txt", d); err != nil {
+		t.Errorf("sync: %v\n", err)
+	}
+
+	if _, err = fs.Copy("adm", "/moe-moe.txt", "/copy.txt"); err != Erofs {
+		t.Errorf("copy: got %v, expected %v\n", err, Erofs)
+	}
+	if err = fs.Move("adm", "/moe-moe.txt", "/moved.txt"); err != Erofs {
+		t.Errorf("move: got %v, expected %v\n", err, Erofs)
+	}
+	if err = fs.SetMeta("/moe-moe.txt", ContentType, "text/plain"); err != Erofs {
+		t.Errorf("set metadata: got %v, expected %v\n", err, Erofs)
+	}
+
+	// SetReadOnly turns it off again.
+	fs.SetReadOnly(false)
+	if err = create(conn, "adm", "/new.txt", 0644); err != nil {
+		t.Errorf("create after SetReadOnly(false): %v\n", err)
+	}
+}
+
+func TestBadNames(t *testing.T) {
+
+	runserver(rootdir, port)
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want *p.Error
+	}{
+		{"../evil", Ebadname},
+		{"a/b", Ebadname},
+		{"/etc", Ebadname},
+		{"nul\x00", Ebadname},
+		{"new\nline", Ebadname},
+		{"tab\t", Ebadname},
+		{uidgidFile, Ebadname},
+		{"moe-moe.txt:1:1", Ebadname},
+		{strings.Repeat("x", maxFilename+1), Enametoolong},
+	} {
+		p.PackTwalk(tx, 1, 2, nil)
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk: %v %v\n", rx, err)
+		}
+
+		p.PackTcreate(tx, 2, tt.name, 0644, p.OWRITE, "", false)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rerror || rx.Error != tt.want.Err {
+			t.Errorf("create %q: got %v %v, expected %v\n", tt.name, rx, err, tt.want)
+		}
+
+		// Renames are checked the same way.
+		p.PackTwalk(tx, 1, 3, []string{"moe-moe.txt"})
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk: %v %v\n", rx, err)
+		}
+		d := p.Dir{Type: ^uint16(0), Dev: ^uint32(0), Mode: ^uint32(0),
+			Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0), Name: tt.name}
+		d.Qid = p.Qid{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)}
+		p.PackTwstat(tx, 3, &d, false)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rerror || rx.Error != tt.want.Err {
+			t.Errorf("rename to %q: got %v %v, expected %v\n", tt.name, rx, err, tt.want)
+		}
+
+		for _, fid := range []uint32{2, 3} {
+			p.PackTclunk(tx, fid)
+			c.rpc(tx, 1)
+		}
+	}
+
+	// A name with a slash cannot be walked either.
+	p.PackTwalk(tx, 1, 2, []string{"../.."})
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rerror {
+		t.Errorf("walk ../..: got %v %v, expected an error\n", rx, err)
+	}
+
+	if _, err = os.Stat(rootdir + "/../evil"); err == nil {
+		t.Error("created a file outside the root")
+	}
+	if _, err = os.Stat(rootdir + "/moe-moe.txt"); err != nil {
+		t.Errorf("moe-moe.txt was renamed: %v\n", err)
+	}
+}
+
+func TestCreateQidType(t *testing.T) {
+
+	fs := newfs(rootdir)
+	s := fs.Connect("adm")
+
+	for _, tt := range []struct {
+		name string
+		perm uint32
+		want uint8
+	}{
+		{"file", 0644, p.QTFILE},
+		{"dir", p.DMDIR | 0755, p.QTDIR},
+		{"log", p.DMAPPEND | 0644, p.QTAPPEND},
+		{"lock", p.DMEXCL | 0644, p.QTEXCL},
+	} {
+		fid, err := s.Walk("/")
+		if err != nil {
+			t.Fatalf("walk: %v\n", err)
+		}
+		qid, err := s.Create(fid, tt.name, tt.perm, p.OREAD)
+		if err != nil {
+			t.Fatalf("create %s: %v\n", tt.name, err)
+		}
+		if qid.Type != tt.want {
+			t.Errorf("%s: qid type %#x, expected %#x\n", tt.name, qid.Type, tt.want)
+		}
+		d, err := s.Stat(fid)
+		if err != nil {
+			t.Fatalf("stat %s: %v\n", tt.name, err)
+		}
+		if d.Qid.Type != tt.want {
+			t.Errorf("%s: stat qid type %#x, expected %#x\n", tt.name, d.Qid.Type, tt.want)
+		}
+		s.Clunk(fid)
+	}
+}
+
+func TestDirQidVersion(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	err := os.Mkdir(rootdir+"/made", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+	st, err := os.Stat(rootdir + "/made")
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+
+	s := fs.Connect("adm")
+	fid, err := s.Walk("/made")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(fid)
+	d, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+
+	// The version comes from the mtime alone; the type is separate.
+	if want := uint32(st.ModTime().UnixNano() / 1000000); d.Qid.Version != want {
+		t.Errorf("qid version %#x, expected %#x\n", d.Qid.Version, want)
+	}
+	if d.Qid.Type != p.QTDIR {
+		t.Errorf("qid type %#x, expected %#x\n", d.Qid.Type, p.QTDIR)
+	}
+}
+
+func TestOutsideChanges(t *testing.T) {
+
+	fs := newfs(rootdir)
+	s := fs.Connect("adm")
+
+	// A file made behind the server's back can be walked to at once.
+	fn := rootdir + "/outside.txt"
+	err := ioutil.WriteFile(fn, []byte("12345"), 0644)
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	fid, err := s.Walk("/outside.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(fid)
+	d, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Length != 5 {
+		t.Errorf("length %d, expected 5\n", d.Length)
+	}
+
+	// Changes to it show in the next stat.
+	err = ioutil.WriteFile(fn, []byte("1234567890"), 0644)
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(fn, later, later)
+	if err != nil {
+		t.Fatalf("chtimes: %v\n", err)
+	}
+	d1, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d1.Length != 10 {
+		t.Errorf("length %d, expected 10\n", d1.Length)
+	}
+	if d1.Mtime != uint32(later.Unix()) {
+		t.Errorf("mtime %d, expected %d\n", d1.Mtime, later.Unix())
+	}
+	if d1.Qid.Version == d.Qid.Version {
+		t.Errorf("qid version %#x did not change\n", d1.Qid.Version)
+	}
+}
+
+func TestDeepWalk(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	// Nothing is read from disk until a walk reaches it.
+	deep := "/a/b/c/d/e/f/g/h"
+	err := os.MkdirAll(rootdir+deep, 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+	err = ioutil.WriteFile(rootdir+deep+"/leaf", []byte("leaf"), 0644)
+	if err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+
+	s := fs.Connect("adm")
+	fid, err := s.Walk(deep + "/leaf")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	defer s.Clunk(fid)
+	d, err := s.Stat(fid)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if d.Name != "leaf" || d.Length != 4 {
+		t.Errorf("stat: got %s %d, expected leaf 4\n", d.Name, d.Length)
+	}
+}
+
+func TestNoAtime(t *testing.T) {
+
+	if oNoatime == 0 {
+		t.Skip("NoAtime not supported")
+	}
+
+	fs := newfs(rootdir)
+	fs.NoAtime = true
+
+	fn := rootdir + "/moe-moe.txt"
+	old := time.Now().Add(-72 * time.Hour)
+	err := os.Chtimes(fn, old, old.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("chtimes: %v\n", err)
+	}
+
+	s := fs.Connect("moe")
+	fid, err := s.Walk("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	if _, err = s.Open(fid, p.OREAD); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	if _, err = s.Read(fid, make([]byte, 64), 0); err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	s.Clunk(fid)
+
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("stat: %v\n", err)
+	}
+	if at := atime(st.Sys().(*syscall.Stat_t)); at.Unix() != old.Unix() {
+		t.Errorf("atime changed from %v to %v\n", old, at)
+	}
+}
+
+func TestDotuErrno(t *testing.T) {
+
+	runserverWith(rootdir, port, func(fs *VuFs) { fs.Dotu = true })
+
+	c, err := dialRawVersion(8192, "9P2000.u")
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+	if !c.dotu {
+		t.Fatal("9P2000.u not negotiated")
+	}
+
+	tx := p.NewFcall(c.msize)
+	for fid, uname := range map[uint32]string{1: "moe", 2: "adm"} {
+		p.PackTattach(tx, fid, p.NOFID, uname, "/", p.NOUID, true)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rattach {
+			t.Fatalf("attach %s: %v %v\n", uname, rx, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		what  string
+		fid   uint32
+		send  func(newfid uint32)
+		errno syscall.Errno
+	}{
+		{"moe create in /", 1, func(fid uint32) {
+			p.PackTcreate(tx, fid, "x", 0644, p.OWRITE, "", true)
+		}, syscall.EACCES},
+		{"walk to a missing file", 2, func(fid uint32) {
+			p.PackTwalk(tx, fid, 4, []string{"missing"})
+		}, syscall.ENOENT},
+		{"create an existing file", 2, func(fid uint32) {
+			p.PackTcreate(tx, fid, "moe-moe.txt", 0644, p.OWRITE, "", true)
+		}, syscall.EEXIST},
+		{"open / for writing", 2, func(fid uint32) {
+			p.PackTopen(tx, fid, p.OWRITE)
+		}, syscall.EISDIR},
+	} {
+		p.PackTwalk(tx, tt.fid, 3, nil)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk: %v %v\n", rx, err)
+		}
+
+		tt.send(3)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rerror || rx.Errornum != uint32(tt.errno) {
+			t.Errorf("%s: got %v %v, expected errno %d\n", tt.what, rx, err, tt.errno)
+		}
+
+		p.PackTclunk(tx, 3)
+		c.rpc(tx, 1)
+	}
+}
+
+func TestDotu(t *testing.T) {
+
+	var moe p.User
+	runserverWith(rootdir, port, func(fs *VuFs) { moe = fs.Upool.Uname2User("moe") })
+
+	for _, version := range []string{"9P2000", "9P2000.u"} {
+		c, err := dialRawVersion(8192, version)
+		if err != nil {
+			t.Fatalf("%s: dial: %v\n", version, err)
+		}
+		defer c.Close()
+		if c.dotu != (version == "9P2000.u") {
+			t.Errorf("%s: negotiated dotu %v\n", version, c.dotu)
+		}
+
+		tx := p.NewFcall(c.msize)
+		p.PackTattach(tx, 1, p.NOFID, "moe", "/", p.NOUID, c.dotu)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rattach {
+			t.Fatalf("%s: attach: %v %v\n", version, rx, err)
+		}
+
+		// The stat of a file has numeric ids only with 9P2000.u.
+		p.PackTwalk(tx, 1, 2, []string{"moe-moe.txt"})
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("%s: walk: %v %v\n", version, rx, err)
+		}
+		p.PackTstat(tx, 2)
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rstat {
+			t.Fatalf("%s: stat: %v %v\n", version, rx, err)
+		}
+		d := rx.Dir
+		if d.Name != "moe-moe.txt" || d.Uid != "moe" {
+			t.Errorf("%s: stat: %v\n", version, &d)
+		}
+		if c.dotu && d.Uidnum != uint32(moe.Id()) {
+			t.Errorf("%s: uidnum %d, expected %d\n", version, d.Uidnum, moe.Id())
+		}
+		if !c.dotu && d.Uidnum == uint32(moe.Id()) {
+			t.Errorf("%s: uidnum sent without 9P2000.u\n", version)
+		}
+
+		// Directory entries are packed the same way.
+		p.PackTwalk(tx, 1, 3, nil)
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("%s: walk: %v %v\n", version, rx, err)
+		}
+		p.PackTopen(tx, 3, p.OREAD)
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Ropen {
+			t.Fatalf("%s: open: %v %v\n", version, rx, err)
+		}
+		p.PackTread(tx, 3, 0, c.msize-p.IOHDRSZ)
+		if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rread {
+			t.Fatalf("%s: read: %v %v\n", version, rx, err)
+		}
+		found := false
+		for b := rx.Data; len(b) > 0; {
+			d, rest, _, err := p.UnpackDir(b, c.dotu)
+			if err != nil {
+				t.Fatalf("%s: unpack: %v\n", version, err)
+			}
+			if d.Name == "moe-moe.txt" {
+				found = true
+				if c.dotu && d.Uidnum != uint32(moe.Id()) {
+					t.Errorf("%s: entry uidnum %d, expected %d\n", version, d.Uidnum, moe.Id())
+				}
+			}
+			b = rest
+		}
+		if !found {
+			t.Errorf("%s: moe-moe.txt not listed\n", version)
+		}
+	}
+}
+
+func TestPartialWalk(t *testing.T) {
+
+	runserver(rootdir, port)
+	err := os.MkdirAll(rootdir+"/w/x", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+	root := rx.Qid
+
+	// Return the qid of fid, or nil if there is no such fid.
+	stat := func(fid uint32) *p.Qid {
+		p.PackTstat(tx, fid)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rstat {
+			return nil
+		}
+		return &rx.Dir.Qid
+	}
+
+	for _, tt := range []struct {
+		names  []string
+		nqids  int    // -1 for an error
+		newfid string // what newfid refers to, if installed
+	}{
+		{[]string{"w", "x"}, 2, "x"},
+		{[]string{"missing"}, -1, ""},
+		{[]string{"w", "missing", "x"}, 1, ""},
+		{[]string{"w", "x", "missing"}, 2, ""},
+		{[]string{".."}, 1, "/"},
+		{[]string{"w", "x", "..", ".."}, 4, "/"},
+		{nil, 0, "/"},
+	} {
+		p.PackTwalk(tx, 1, 2, tt.names)
+		rx, err = c.rpc(tx, 1)
+		if err != nil {
+			t.Fatalf("walk %v: %v\n", tt.names, err)
+		}
+		switch {
+		case tt.nqids < 0 && rx.Type != p.Rerror:
+			t.Errorf("walk %v: got %v, expected an error\n", tt.names, rx)
+		case tt.nqids >= 0 && (rx.Type != p.Rwalk || len(rx.Wqid) != tt.nqids):
+			t.Errorf("walk %v: got %v, expected %d qids\n", tt.names, rx, tt.nqids)
+		}
+
+		q := stat(2)
+		switch {
+		case tt.newfid == "" && q != nil:
+			t.Errorf("walk %v: newfid installed\n", tt.names)
+		case tt.newfid == "/" && (q == nil || q.Path != root.Path):
+			t.Errorf("walk %v: newfid is %v, expected the root\n", tt.names, q)
+		case tt.newfid == "x" && (q == nil || q.Path == root.Path):
+			t.Errorf("walk %v: newfid is %v, expected x\n", tt.names, q)
+		}
+		if tt.nqids > 0 && rx.Type == p.Rwalk && tt.names[0] == ".." && rx.Wqid[0].Path != root.Path {
+			t.Errorf("walk %v: qid %v, expected the root's\n", tt.names, rx.Wqid[0])
+		}
+
+		p.PackTclunk(tx, 2)
+		c.rpc(tx, 1)
+	}
+
+	// A partial walk of a fid to itself leaves it unchanged.
+	p.PackTwalk(tx, 1, 2, nil)
+	if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+		t.Fatalf("clone: %v %v\n", rx, err)
+	}
+	p.PackTwalk(tx, 2, 2, []string{"w", "missing"})
+	if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk || len(rx.Wqid) != 1 {
+		t.Errorf("partial walk of fid to itself: %v %v\n", rx, err)
+	}
+	if q := stat(2); q == nil || q.Path != root.Path {
+		t.Errorf("fid is %v after partial walk, expected the root\n", q)
+	}
+	p.PackTwalk(tx, 2, 2, []string{"w"})
+	if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk || len(rx.Wqid) != 1 {
+		t.Errorf("walk after partial walk: %v %v\n", rx, err)
+	}
+}
+
+func TestMaxWelem(t *testing.T) {
+
+	runserver(rootdir, port)
+	err := os.MkdirAll(rootdir+"/d/d/d/d/d/d/d/d/d/d/d/d/d/d/d/d/d", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+
+	names := strings.Split(strings.Repeat("d ", maxWelem+1), " ")[:maxWelem+1]
+	p.PackTwalk(tx, 1, 2, names)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rerror || rx.Error != Etoomanywelem.Err {
+		t.Errorf("walk %d names: got %v %v, expected %v\n", len(names), rx, err, Etoomanywelem)
+	}
+
+	p.PackTwalk(tx, 1, 2, names[:maxWelem])
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rwalk || len(rx.Wqid) != maxWelem {
+		t.Errorf("walk %d names: %v %v\n", maxWelem, rx, err)
+	}
+}
+
+// Return the number of files under dir the process has open, or -1
+// if unknown.  Sockets and other files come and go as earlier tests'
+// connections close, so they are not counted.
+func openFiles(dir string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	n := 0
+	for _, fd := range fds {
+		fn, err := os.Readlink("/proc/self/fd/" + fd.Name())
+		if err == nil && strings.HasPrefix(fn, dir+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCreateOpenClunk(t *testing.T) {
+
+	if openFiles(rootdir) < 0 {
+		t.Skip("cannot count open files")
+	}
+
+	runserver(rootdir, port)
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+
+	before := openFiles(rootdir)
+
+	// Create opens the file on fid 2; fid 3 opens it again.
+	for _, tx1 := range []func(){
+		func() { p.PackTwalk(tx, 1, 2, nil) },
+		func() { p.PackTcreate(tx, 2, "new.txt", 0644, p.OWRITE, "", false) },
+		func() { p.PackTwalk(tx, 1, 3, []string{"new.txt"}) },
+		func() { p.PackTopen(tx, 3, p.OREAD) },
+	} {
+		tx1()
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type == p.Rerror {
+			t.Fatalf("%v: %v %v\n", tx, rx, err)
+		}
+	}
+	if n := openFiles(rootdir); n != before+2 {
+		t.Errorf("%d files open with two fids open, expected %d\n", n, before+2)
+	}
+
+	for _, fid := range []uint32{2, 3} {
+		p.PackTclunk(tx, fid)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rclunk {
+			t.Fatalf("clunk %d: %v %v\n", fid, rx, err)
+		}
+	}
+	if n := openFiles(rootdir); n != before {
+		t.Errorf("%d files open after clunks, expected %d\n", n, before)
+	}
+}
+
+func TestCreateDirs(t *testing.T) {
+
+	if openFiles(rootdir) < 0 {
+		t.Skip("cannot count open files")
+	}
+
+	runserver(rootdir, port)
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+
+	before := openFiles(rootdir)
+
+	// Leave every created directory's fid open.
+	const ndirs = 50
+	for i := 0; i < ndirs; i++ {
+		fid := uint32(2 + i)
+		p.PackTwalk(tx, 1, fid, nil)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk: %v %v\n", rx, err)
+		}
+		name := fmt.Sprintf("dir%d", i)
+		p.PackTcreate(tx, fid, name, p.DMDIR|0755, p.OREAD, "", false)
+		rx, err = c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rcreate {
+			t.Fatalf("create %s: %v %v\n", name, rx, err)
+		}
+	}
+
+	if n := openFiles(rootdir); n != before {
+		t.Errorf("%d files open after creating %d directories, expected %d\n", n, ndirs, before)
+	}
+}
+
+func TestVersionFirst(t *testing.T) {
+
+	runserver(rootdir, port)
+
+	nc, err := net.Dial("tcp", port)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	// Until a Tversion, go9p replies in 9P2000.u if it can.
+	c := &rawConn{nc, 8192, true}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	if rx.Type != p.Rerror || rx.Error != Enoversion.Err {
+		t.Errorf("attach before version: got %v, expected %v\n", rx, Enoversion)
+	}
+
+	p.PackTversion(tx, c.msize, "9P2000")
+	rx, err = c.rpc(tx, p.NOTAG)
+	if err != nil || rx.Type != p.Rversion {
+		t.Fatalf("version: %v %v\n", rx, err)
+	}
+	c.dotu = false
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Errorf("attach after version: %v %v\n", rx, err)
+	}
+}
+
+// As walk(5) says, newfid must not be in use unless it is fid, with
+// or without names to walk.
+func TestWalkFids(t *testing.T) {
+
+	runserver(rootdir, port)
+	err := os.MkdirAll(rootdir+"/w/x", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	for _, fid := range []uint32{1, 2} {
+		p.PackTattach(tx, fid, p.NOFID, "adm", "/", p.NOUID, false)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rattach {
+			t.Fatalf("attach %d: %v %v\n", fid, rx, err)
+		}
+	}
+
+	// Return the name of the file fid refers to, or "" if none.
+	name := func(fid uint32) string {
+		p.PackTstat(tx, fid)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rstat {
+			return ""
+		}
+		return rx.Dir.Name
+	}
+	root := name(1)
+	want := func(n string) string {
+		if n == "/" {
+			return root
+		}
+		return n
+	}
+
+	for _, tt := range []struct {
+		fid, newfid uint32
+		names       []string
+		ok          bool
+		fidname     string // what fid refers to after
+		newfidname  string // and newfid
+	}{
+		// Attaching to a fid in use fails.
+		{p.NOFID, 1, nil, false, "", "/"},
+
+		{1, 1, nil, true, "/", "/"},
+		{1, 3, nil, true, "/", "/"},
+		{1, 2, nil, false, "/", "/"},
+
+		{1, 4, []string{"w"}, true, "/", "w"},
+		{1, 2, []string{"w"}, false, "/", "/"},
+		{4, 4, []string{"x"}, true, "x", "x"},
+	} {
+		if tt.fid == p.NOFID {
+			p.PackTattach(tx, tt.newfid, p.NOFID, "adm", "/", p.NOUID, false)
+		} else {
+			p.PackTwalk(tx, tt.fid, tt.newfid, tt.names)
+		}
+		rx, err := c.rpc(tx, 1)
+		if err != nil {
+			t.Fatalf("%d -> %d %v: %v\n", tt.fid, tt.newfid, tt.names, err)
+		}
+		if ok := rx.Type != p.Rerror; ok != tt.ok {
+			t.Errorf("%d -> %d %v: got %v\n", tt.fid, tt.newfid, tt.names, rx)
+		}
+		if tt.fid != p.NOFID {
+			if n := name(tt.fid); n != want(tt.fidname) {
+				t.Errorf("%d -> %d %v: fid is '%s', expected '%s'\n", tt.fid, tt.newfid, tt.names, n, tt.fidname)
+			}
+		}
+		if n := name(tt.newfid); n != want(tt.newfidname) {
+			t.Errorf("%d -> %d %v: newfid is '%s', expected '%s'\n", tt.fid, tt.newfid, tt.names, n, tt.newfidname)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	for _, d := range []string{"/a", "/b"} {
+		err := os.Mkdir(rootdir+d, 0775)
+		if err != nil {
+			t.Fatalf("Mkdir(%s): %v\n", d, err)
+		}
+	}
+	err := ioutil.WriteFile(rootdir+"/a/x.txt", []byte("x"), 0664)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	err = ioutil.WriteFile(rootdir+"/a/"+uidgidFile, []byte("x.txt:3:3\n"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	err = fs.SetMeta("/a/x.txt", ContentType, "text/plain")
+	if err != nil {
+		t.Fatalf("SetMeta: %v\n", err)
+	}
+
+	// Only adm can write to /a and /b.
+	err = fs.Move("moe", "/a/x.txt", "/b/x.txt")
+	if err != ErrPerm {
+		t.Errorf("moe move: got %v, expected %v\n", err, ErrPerm)
+	}
+
+	err = fs.Move("adm", "/a/x.txt", "/b/x.txt")
+	if err != nil {
+		t.Fatalf("adm move: %v\n", err)
+	}
+
+	contents, err := read(conn, "adm", "/b/x.txt")
+	if err != nil {
+		t.Fatalf("read: %v\n", err)
+	}
+	if contents != "x" {
+		t.Errorf("moved file contains '%s', expected 'x'\n", contents)
+	}
+	uid, gid, err := usergroup(conn, "/b/x.txt", "adm")
+	if err != nil {
+		t.Fatalf("usergroup: %v\n", err)
+	}
+	if uid != "moe" || gid != "moe" {
+		t.Errorf("moved file is %s:%s, expected moe:moe\n", uid, gid)
+	}
+	meta, err := fs.Meta("/b/x.txt")
+	if err != nil {
+		t.Fatalf("Meta: %v\n", err)
+	}
+	if meta[ContentType] != "text/plain" {
+		t.Errorf("moved content type = '%s'\n", meta[ContentType])
+	}
+
+	if _, err = os.Stat(rootdir + "/a/x.txt"); !os.IsNotExist(err) {
+		t.Errorf("/a/x.txt still exists: %v\n", err)
+	}
+	data, err := ioutil.ReadFile(rootdir + "/a/" + uidgidFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if strings.Contains(string(data), "x.txt") {
+		t.Errorf("/a/%s still lists x.txt: '%s'\n", uidgidFile, data)
+	}
+
+	for _, tt := range []struct {
+		src, dst string
+		err      error
+	}{
+		{"/b/x.txt", "/moe-moe.txt", ErrExist},
+		{"/b/x.txt", "/c/x.txt", ErrNotExist},
+		{"/a/x.txt", "/b/y.txt", ErrNotExist},
+		{"/b/x.txt", "/a/" + uidgidFile, Ebadname},
+		{"/", "/a/root", srv.Ebaduse},
+	} {
+		err = fs.Move("adm", tt.src, tt.dst)
+		if err != tt.err {
+			t.Errorf("Move(%s, %s): got %v, expected %v\n", tt.src, tt.dst, err, tt.err)
+		}
+	}
+
+	// Paths are found as a walk would find them: a link can't take
+	// a file out of the tree, even to a directory anyone may write,
+	// and moe can't search /private to reach the writable /private/w.
+	out, err := ioutil.TempDir("", "vufs-out")
+	if err != nil {
+		t.Fatalf("TempDir: %v\n", err)
+	}
+	defer os.RemoveAll(out)
+	for _, d := range []string{"/pub", "/private", "/private/w"} {
+		if err = os.Mkdir(rootdir+d, 0777); err != nil {
+			t.Fatalf("Mkdir(%s): %v\n", d, err)
+		}
+	}
+	for d, mode := range map[string]os.FileMode{out: 0777, rootdir + "/pub": 0777,
+		rootdir + "/private": 0700, rootdir + "/private/w": 0777} {
+		if err = os.Chmod(d, mode); err != nil {
+			t.Fatalf("Chmod(%s): %v\n", d, err)
+		}
+	}
+	err = ioutil.WriteFile(rootdir+"/pub/m.txt", []byte("m"), 0666)
+	if err == nil {
+		err = os.Symlink(out, rootdir+"/out")
+	}
+	if err == nil {
+		err = os.Symlink("/etc", rootdir+"/etc")
+	}
+	if err != nil {
+		t.Fatalf("setup: %v\n", err)
+	}
+	for _, tt := range []struct {
+		uname, src, dst string
+	}{
+		{"moe", "/pub/m.txt", "/out/m.txt"},
+		{"adm", "/b/x.txt", "/etc/x.txt"},
+		{"moe", "/pub/m.txt", "/private/w/m.txt"},
+	} {
+		err = fs.Move(tt.uname, tt.src, tt.dst)
+		if err != ErrPerm {
+			t.Errorf("%s Move(%s, %s): got %v, expected %v\n", tt.uname, tt.src, tt.dst, err, ErrPerm)
+		}
+	}
+	if _, err = os.Stat(rootdir + "/pub/m.txt"); err != nil {
+		t.Errorf("/pub/m.txt was moved: %v\n", err)
+	}
+}
+
+func TestRootMode(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	// The root is served with its mode on disk, owned by adm.
+	for _, tt := range []struct {
+		mode   os.FileMode
+		moeCan bool
+	}{
+		{0755, false},
+		{0777, true},
+	} {
+		err := os.Chmod(rootdir, tt.mode)
+		if err != nil {
+			t.Fatalf("Chmod: %v\n", err)
+		}
+		for _, uname := range []string{"moe", "adm"} {
+			s := fs.Connect(uname)
+			fid, err := s.Walk("/")
+			if err != nil {
+				t.Fatalf("walk: %v\n", err)
+			}
+			d, err := s.Stat(fid)
+			if err != nil {
+				t.Fatalf("stat: %v\n", err)
+			}
+			if d.Mode&0777 != uint32(tt.mode) || d.Uid != "adm" {
+				t.Errorf("root is %o %s, expected %o adm\n", d.Mode&0777, d.Uid, tt.mode)
+			}
+			name := fmt.Sprintf("%s-%o.txt", uname, tt.mode)
+			_, err = s.Create(fid, name, 0664, p.OWRITE)
+			s.Clunk(fid)
+			can := uname == "adm" || tt.moeCan
+			if can && err != nil {
+				t.Errorf("%s create in %o root: %v\n", uname, tt.mode, err)
+			}
+			if !can && err != ErrPerm {
+				t.Errorf("%s create in %o root: got %v, expected %v\n", uname, tt.mode, err, ErrPerm)
+			}
+		}
+	}
+	os.Chmod(rootdir, 0775)
+}
+
+func TestOpenExec(t *testing.T) {
+
+	fs := newfs(rootdir)
+	err := ioutil.WriteFile(rootdir+"/prog", []byte("#!/bin/rc\n"), 0711)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	err = os.Chmod(rootdir+"/prog", 0711)
+	if err != nil {
+		t.Fatalf("Chmod: %v\n", err)
+	}
+
+	// moe may execute /prog but not read it.
+	moe := fs.Connect("moe")
+	for _, tt := range []struct {
+		mode uint8
+		err  error
+	}{
+		{p.OEXEC, nil},
+		{p.OREAD, ErrPerm},
+		{p.ORDWR, ErrPerm},
+	} {
+		fid, err := moe.Walk("/prog")
+		if err != nil {
+			t.Fatalf("walk: %v\n", err)
+		}
+		_, err = moe.Open(fid, tt.mode)
+		moe.Clunk(fid)
+		if err != tt.err {
+			t.Errorf("open mode %d: got %v, expected %v\n", tt.mode, err, tt.err)
+		}
+	}
+
+	// Without exec permission, OEXEC fails.
+	fid, err := moe.Walk("/moe-moe.txt")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	_, err = moe.Open(fid, p.OEXEC)
+	moe.Clunk(fid)
+	if err != ErrPerm {
+		t.Errorf("OEXEC of /moe-moe.txt: got %v, expected %v\n", err, ErrPerm)
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+
+	fs := newfs(rootdir)
+	err := os.Symlink("/etc", rootdir+"/etc")
+	if err == nil {
+		err = os.Symlink("moe-moe.txt", rootdir+"/moe")
+	}
+	if err != nil {
+		t.Fatalf("symlink: %v\n", err)
+	}
+
+	for _, tt := range []struct {
+		follow bool
+		path   string
+		ok     bool
+	}{
+		{false, "/etc", false},
+		{false, "/etc/passwd", false},
+		{false, "/moe", false},
+		{true, "/etc", false},
+		{true, "/etc/passwd", false},
+		{true, "/moe", true},
+	} {
+		fs.FollowSymlinks = tt.follow
+		s := fs.Connect("adm")
+		fid, err := s.Walk(tt.path)
+		if err == nil {
+			s.Clunk(fid)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("follow %v: walk %s: got %v\n", tt.follow, tt.path, err)
+		}
+	}
+
+	// The other calls that take a path find it as a walk would.
+	out := t.TempDir()
+	err = ioutil.WriteFile(out+"/f.txt", []byte("out\n"), 0666)
+	if err == nil {
+		err = os.Symlink(out, rootdir+"/out")
+	}
+	if err != nil {
+		t.Fatalf("setup: %v\n", err)
+	}
+	for _, follow := range []bool{false, true} {
+		fs.FollowSymlinks = follow
+		if _, err := fs.Copy("adm", "/etc/passwd", "/passwd"); err == nil {
+			t.Errorf("follow %v: copied /etc/passwd\n", follow)
+		}
+		if _, err := fs.Copy("adm", "/moe-moe.txt", "/out/copy.txt"); err == nil {
+			t.Errorf("follow %v: copied into /out\n", follow)
+		}
+		if err := fs.Move("adm", "/out/f.txt", "/f.txt"); err == nil {
+			t.Errorf("follow %v: moved /out/f.txt\n", follow)
+		}
+		if err := fs.Move("adm", "/moe-moe.txt", "/etc/moe.txt"); err == nil {
+			t.Errorf("follow %v: moved into /etc\n", follow)
+		}
+		if err := fs.SetMeta("/out/f.txt", ContentType, "text/plain"); err == nil {
+			t.Errorf("follow %v: set metadata on /out/f.txt\n", follow)
+		}
+		if _, err := fs.Meta("/out/f.txt"); err == nil {
+			t.Errorf("follow %v: got metadata of /out/f.txt\n", follow)
+		}
+		if _, _, _, err := fs.EffectivePerm("adm", "/etc/passwd"); err == nil {
+			t.Errorf("follow %v: got permissions of /etc/passwd\n", follow)
+		}
+		if ok, _ := fs.CanAccess("adm", "/etc/passwd", p.DMREAD); ok {
+			t.Errorf("follow %v: can read /etc/passwd\n", follow)
+		}
+	}
+	if _, err := os.Stat(out + "/f.txt"); err != nil {
+		t.Errorf("/out/f.txt: %v\n", err)
+	}
+	if _, err := os.Stat(rootdir + "/moe-moe.txt"); err != nil {
+		t.Errorf("/moe-moe.txt: %v\n", err)
+	}
+	if _, err := os.Stat(out + "/copy.txt"); err == nil {
+		t.Errorf("/out/copy.txt was created\n")
+	}
+}
+
+func TestWalkDotDot(t *testing.T) {
+
+	runserver(rootdir, port)
+	err := os.MkdirAll(rootdir+"/a/b/c", 0755)
+	if err != nil {
+		t.Fatalf("mkdir: %v\n", err)
+	}
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	rx, err := c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+	root := rx.Qid
+
+	// Walking up more often than down stops at the root.
+	names := []string{"a", "b", "c"}
+	for i := 0; i < 10; i++ {
+		names = append(names, "..")
+	}
+	p.PackTwalk(tx, 1, 2, names)
+	rx, err = c.rpc(tx, 1)
+	if err != nil || rx.Type != p.Rwalk || len(rx.Wqid) != len(names) {
+		t.Fatalf("walk %v: %v %v\n", names, rx, err)
+	}
+	if q := rx.Wqid[len(names)-1]; q.Path != root.Path {
+		t.Errorf("walk %v ended at %v, expected the root %v\n", names, q, root)
+	}
+	p.PackTwalk(tx, 2, 3, []string{"moe-moe.txt"})
+	if rx, err = c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+		t.Errorf("walk to moe-moe.txt from there: %v %v\n", rx, err)
+	}
+
+	fs := New(rootdir)
+	for _, tt := range []struct {
+		path string
+		ok   bool
+	}{
+		{rootdir, true},
+		{rootdir + "/a/b", true},
+		{rootdir + "/a/../..", false},
+		{rootdir + "x", false},
+		{"/etc", false},
+	} {
+		if fs.inRoot(tt.path) != tt.ok {
+			t.Errorf("inRoot(%s) is %v, expected %v\n", tt.path, !tt.ok, tt.ok)
+		}
+	}
+}
+
+func TestDirErrors(t *testing.T) {
+
+	runserver(rootdir, port)
+	c, err := dialRaw(8192)
+	if err != nil {
+		t.Fatalf("dial: %v\n", err)
+	}
+	defer c.Close()
+
+	tx := p.NewFcall(c.msize)
+	p.PackTattach(tx, 1, p.NOFID, "adm", "/", p.NOUID, false)
+	if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rattach {
+		t.Fatalf("attach: %v %v\n", rx, err)
+	}
+
+	for _, tt := range []struct {
+		what  string
+		send  func(fid uint32)
+		error *p.Error
+	}{
+		{"open / for writing", func(fid uint32) {
+			p.PackTopen(tx, fid, p.OWRITE)
+		}, Eisdir},
+		{"open / to truncate", func(fid uint32) {
+			p.PackTopen(tx, fid, p.OREAD|p.OTRUNC)
+		}, Eisdir},
+		{"write to /", func(fid uint32) {
+			p.PackTopen(tx, fid, p.OREAD)
+			c.rpc(tx, 1)
+			p.PackTwrite(tx, fid, 0, 1, []byte("x"))
+		}, Eisdir},
+		{"walk through a file", func(fid uint32) {
+			p.PackTwalk(tx, fid, fid, []string{"moe-moe.txt"})
+			c.rpc(tx, 1)
+			p.PackTwalk(tx, fid, 3, []string{"x"})
+		}, Enotdir.(*p.Error)},
+	} {
+		p.PackTwalk(tx, 1, 2, nil)
+		if rx, err := c.rpc(tx, 1); err != nil || rx.Type != p.Rwalk {
+			t.Fatalf("walk: %v %v\n", rx, err)
+		}
+
+		tt.send(2)
+		rx, err := c.rpc(tx, 1)
+		if err != nil || rx.Type != p.Rerror || rx.Error != tt.error.Err {
+			t.Errorf("%s: got %v %v, expected %v\n", tt.what, rx, err, tt.error)
+		}
+
+		p.PackTclunk(tx, 2)
+		c.rpc(tx, 1)
+	}
+
+	// The in-process API gives the same errors.
+	s := newfs(rootdir).Connect("adm")
+	fid, err := s.Walk("/")
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	if _, err = s.Open(fid, p.OWRITE); err != Eisdir {
+		t.Errorf("open / for writing: got %v, expected %v\n", err, Eisdir)
+	}
+	if _, err = s.Open(fid, p.OREAD); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	if _, err = s.Write(fid, []byte("x"), 0); err != Eisdir {
+		t.Errorf("write to /: got %v, expected %v\n", err, Eisdir)
+	}
+	s.Clunk(fid)
+	if _, err = s.Walk("/moe-moe.txt/x"); err != Enotdir {
+		t.Errorf("walk through a file: got %v, expected %v\n", err, Enotdir)
+	}
+}
+
+func TestFiles(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	for _, tt := range optests {
+
+		if !tt.keepState {
+			initfs(rootdir)
+		}
+
+		switch tt.op {
+
+		default:
+			t.Errorf("Unsupported operation %s in optest = %s\n", tt.op, tt)
+
+		case "delete":
+			err := remove(conn, tt.user, tt.path)
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("%s: %v\n", tt, err)
+				}
+				fp, err := os.Open(rootdir + "/" + tt.path)
+				if err == nil {
+					fp.Close()
+					t.Errorf("%s: delete failed\n", tt)
+				} else if !os.IsNotExist(err) {
+					t.Errorf("%s: after delete, err != IsNotExist: %v\n", tt, err)
+				}
+
+			} else {
+				if err == nil {
+					t.Errorf("%s: was allowed\n", tt)
+				}
+			}
+
+			// User should be user, group should come from directory.
+
+		case "write":
+			err := os.Chmod(rootdir+tt.path, tt.mode)
+			if err != nil {
+				t.Errorf("%+v: chmod failed: %v\n", tt, err)
+			}
+
+			n, newcontents, err := write(conn, tt.user, tt.path, "whom")
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("%s: %v\n", tt, err)
+				}
+
+				if n != 4 {
+					t.Errorf("%s: exp = 4, act = %d\n", tt, n)
+				}
+
+				if newcontents != "whomever" {
+					t.Errorf("%s: exp = 'whomever', act = '%s'\n", tt, newcontents)
+				}
+
+			} else {
+				if err == nil {
+					t.Errorf("%s: was allowed\n", tt)
+				}
+			}
+
+		case "read":
+			err := os.Chmod(rootdir+tt.path, tt.mode)
+			if err != nil {
+				t.Errorf("%+v: chmod failed: %v\n", tt, err)
+			}
+			contents, err := read(conn, tt.user, tt.path)
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("%s: %v\n", tt, err)
+				}
+				f, found := initialFiles[tt.path]
+				if !found {
+					t.Errorf("%s: not found in initialFiles\n", tt)
+				}
+				if contents != f.contents {
+					t.Errorf("%s: exp = '%s', act = '%s'\n", tt, f.contents, contents)
+				}
+			} else {
+				if err == nil {
+					t.Errorf("%s: was allowed\n", tt)
+				}
+			}
+		}
+	}
+}
+
+// permtest is the expected effective permission of a user on a file.
+type permtest struct {
+	user  string
+	mode  os.FileMode
+	path  string
+	read  bool
+	write bool
+	exec  bool
+}
+
+var permtests []permtest = []permtest{
+
+	// Same user and group (moe)
+	{"moe", 0600, "/moe-moe.txt", true, true, false},
+	{"adm", 0600, "/moe-moe.txt", false, false, false},
+	{"curly", 0600, "/moe-moe.txt", false, false, false},
+
+	{"moe", 0750, "/moe-moe.txt", true, true, true},
+	{"curly", 0750, "/moe-moe.txt", false, false, false},
+
+	{"moe", 0444, "/moe-moe.txt", true, false, false},
+	{"curly", 0444, "/moe-moe.txt", true, false, false},
+
+	// Different user (larry) and group (moe)
+	{"larry", 0640, "/larry-moe.txt", true, true, false},
+	{"moe", 0640, "/larry-moe.txt", true, false, false},
+	{"curly", 0640, "/larry-moe.txt", false, false, false},
+
+	{"larry", 0461, "/larry-moe.txt", true, false, true},
+	{"moe", 0461, "/larry-moe.txt", true, true, true},
+	{"curly", 0461, "/larry-moe.txt", false, false, true},
+
+	{"moe", 0670, "/larry-moe.txt", true, true, true},
+	{"curly", 0670, "/larry-moe.txt", false, false, false},
 }
 
 var optests []optest = []optest{
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/lionkov/go9p/p"
@@ -40,6 +41,11 @@ type vUser struct {
 	members []p.User
 	// A comma-separated list of groups this user is part of.
 	groups []p.Group
+	// The ids of those groups, for IsMember.
+	groupIds map[int]bool
+	// The users this user was loaded into.  Groups and members are
+	// looked up there, so a user held by a fid sees changes at once.
+	pool *vUsers
 }
 
 // Simple p.Users implementation of virtual users.
@@ -47,6 +53,12 @@ type vUsers struct {
 	root       string
 	nameToUser map[string]*vUser
 	idToUser   map[int]*vUser
+
+	// Who owns files with no owner recorded, so must be in the
+	// users file; if empty, adm.  Set by the VuFs that uses these
+	// users; guarded by the lock.
+	owner string
+
 	sync.Mutex
 }
 
@@ -61,23 +73,36 @@ func (u *vUser) Name() string { return u.name }
 
 func (u *vUser) Id() int { return u.id }
 
-func (u *vUser) Groups() []p.Group { return u.groups }
+func (u *vUser) Groups() []p.Group { return u.current().groups }
 
-func (u *vUser) Members() []p.User { return u.members }
+func (u *vUser) Members() []p.User { return u.current().members }
 
 func (u *vUser) IsMember(g p.Group) bool {
+	if g == nil {
+		return false
+	}
 	// The Id is the immutable fact for the user.
 	// It is what is stored as uid,gid on files.
 	// It happens to be int in the go9p implementation
 	// (as opposed to string in Plan9), but this has the
 	// advantage of using compiler to ensure that we can't
 	// check an Id() against a Name().
-	for _, b := range u.groups {
-		if b.Id() == g.Id() {
-			return true
-		}
+	return u.current().groupIds[g.Id()]
+}
+
+// Return the user as the users were last loaded; u itself if it
+// has since been removed.  Loaded users are never changed, so their
+// groups and members can be used without the lock.
+func (u *vUser) current() *vUser {
+	if u.pool == nil {
+		return u
+	}
+	u.pool.Lock()
+	defer u.pool.Unlock()
+	if cur, ok := u.pool.idToUser[u.id]; ok {
+		return cur
 	}
-	return false
+	return u
 }
 
 func (up *vUsers) Uid2User(uid int) p.User {
@@ -102,11 +127,17 @@ func (up *vUsers) Uname2User(uname string) p.User {
 }
 
 func (up *vUsers) Gid2Group(gid int) p.Group {
-	return up.Uid2User(gid).(p.Group)
+	if g, ok := up.Uid2User(gid).(p.Group); ok {
+		return g
+	}
+	return nil
 }
 
 func (up *vUsers) Gname2Group(gname string) p.Group {
-	return up.Uname2User(gname).(p.Group)
+	if g, ok := up.Uname2User(gname).(p.Group); ok {
+		return g
+	}
+	return nil
 }
 
 // Open userfile.  Create if not found.
@@ -142,16 +173,12 @@ func readUserFile(userfile string) ([]byte, error) {
 
 }
 
-func NewVusers(root string) (*vUsers, error) {
-
-	userfn := filepath.Join(root, usersFile)
-
-	data, err := readUserFile(userfn)
-	if err != nil {
-		return nil, err
-	}
+// Parse the contents of a users file.  Source names the file in
+// error messages.
+func parseUsers(data []byte, source string) (map[string]*vUser, map[int]*vUser, error) {
 
 	nameToUser := make(map[string]*vUser)
+	idToUser := make(map[int]*vUser)
 
 	lines := bytes.Split(data, []byte("\n"))
 	for idx, line := range lines {
@@ -166,26 +193,40 @@ func NewVusers(root string) (*vUsers, error) {
 
 		columns := bytes.Split(line, []byte(":"))
 		if len(columns) != 3 {
-			return nil, fmt.Errorf("Got %d columns (expected %d) on line %d of %s",
-				len(columns), 3, idx, userfn, string(line))
+			return nil, nil, fmt.Errorf("Got %d columns (expected %d) on line %d of %s: %s",
+				len(columns), 3, idx+1, source, string(line))
 		}
 
 		id, err := strconv.Atoi(string(columns[0]))
 		if err != nil {
-			return nil, fmt.Errorf("Can't parse first column as integer on line %d of %s",
-				len(columns), 3, idx, userfn, string(line))
+			return nil, nil, fmt.Errorf("Can't parse first column as integer on line %d of %s: %s",
+				idx+1, source, string(line))
 		}
 		name := string(columns[1])
-		nameToUser[name] = &vUser{
-			id:      id,
-			name:    name,
-			members: make([]p.User, 0),
-			groups:  make([]p.Group, 0)}
+		if name == "" || bytes.ContainsAny(columns[1], string(badUsernameChar)) {
+			return nil, nil, fmt.Errorf("Invalid user name '%s' on line %d of %s",
+				name, idx+1, source)
+		}
+		if _, present := nameToUser[name]; present {
+			return nil, nil, fmt.Errorf("Duplicate user name '%s' on line %d of %s",
+				name, idx+1, source)
+		}
+		if _, present := idToUser[id]; present {
+			return nil, nil, fmt.Errorf("Duplicate user id %d on line %d of %s",
+				id, idx+1, source)
+		}
+		user := &vUser{
+			id:       id,
+			name:     name,
+			members:  make([]p.User, 0),
+			groups:   make([]p.Group, 0),
+			groupIds: make(map[int]bool)}
+		nameToUser[name] = user
+		idToUser[id] = user
 	}
 
 	// Load groups on second pass.
-	lines = bytes.Split(data, []byte("\n"))
-	for _, line := range lines {
+	for idx, line := range lines {
 		if len(line) == 0 {
 			continue
 		}
@@ -195,10 +236,7 @@ func NewVusers(root string) (*vUsers, error) {
 		columns := bytes.Split(line, []byte(":"))
 		name := string(columns[1])
 		groups := columns[2]
-		user, present := nameToUser[name]
-		if !present {
-			panic(fmt.Sprintf("can't find user '%s' after first pass", name))
-		}
+		user := nameToUser[name]
 		groupNames := bytes.Split(groups, []byte(","))
 		for _, groupName := range groupNames {
 			if len(groupName) == 0 {
@@ -206,21 +244,288 @@ func NewVusers(root string) (*vUsers, error) {
 			}
 			group, present := nameToUser[string(groupName)]
 			if !present {
-				panic(fmt.Sprintf("can't find group name '%s' after first pass", groupName))
+				return nil, nil, fmt.Errorf("Unknown group '%s' on line %d of %s",
+					groupName, idx+1, source)
 			}
 			user.groups = append(user.groups, group)
+			user.groupIds[group.id] = true
 			group.members = append(group.members, user)
 		}
 	}
 
-	// Create second map, of ID to user.
-	idToUser := make(map[int]*vUser, len(nameToUser))
-	for _, user := range nameToUser {
-		idToUser[user.Id()] = user
+	return nameToUser, idToUser, nil
+}
+
+// Load the users from root's users file, creating it if it doesn't
+// exist.  The file must have owner, or adm if owner is empty: the
+// user that owns files with no owner recorded (see VuFs.Owner).
+func NewVusers(root, owner string) (*vUsers, error) {
+
+	userfn := filepath.Join(root, usersFile)
+
+	data, err := readUserFile(userfn)
+	if err != nil {
+		return nil, err
+	}
+
+	nameToUser, idToUser, err := parseUsersFile(data, userfn, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &vUsers{root: root, owner: owner}
+	up.load(nameToUser, idToUser)
+	return up, nil
+}
+
+// Make the parsed users current.  The caller holds the lock, if
+// others can see up.
+func (up *vUsers) load(nameToUser map[string]*vUser, idToUser map[int]*vUser) {
+	for _, user := range idToUser {
+		user.pool = up
+	}
+	up.nameToUser = nameToUser
+	up.idToUser = idToUser
+}
+
+// Replace the users file with contents and load it.  If contents
+// don't parse, neither the file nor the users change.  Lookups
+// block until both are updated.
+func (up *vUsers) set(contents []byte) error {
+	up.Lock()
+	defer up.Unlock()
+
+	return up.save(contents)
+}
+
+// Parse the users file, which must have owner, or adm if owner is
+// empty: that user owns the files with no owner recorded.
+func parseUsersFile(data []byte, source, owner string) (map[string]*vUser, map[int]*vUser, error) {
+	nameToUser, idToUser, err := parseUsers(data, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if owner == "" {
+		owner = "adm"
+	}
+	if _, present := nameToUser[owner]; !present {
+		return nil, nil, fmt.Errorf("No user %s in %s; %s owns files with no owner recorded",
+			owner, source, owner)
+	}
+	return nameToUser, idToUser, nil
+}
+
+// Make owner the user the users file must have from now on.
+func (up *vUsers) setOwner(owner string) {
+	up.Lock()
+	defer up.Unlock()
+
+	up.owner = owner
+}
+
+// Parse contents, write them to the users file and load them.
+// The caller holds the lock.
+func (up *vUsers) save(contents []byte) error {
+
+	userfn := filepath.Join(up.root, usersFile)
+
+	nameToUser, idToUser, err := parseUsersFile(contents, userfn, up.owner)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(userfn, contents, 0600)
+	if err != nil {
+		return err
+	}
+
+	up.load(nameToUser, idToUser)
+
+	return nil
+}
+
+// Apply edit to the lines of the users file, then save and load
+// the result.  Edit runs with the lock held.
+func (up *vUsers) edit(edit func(lines []string) ([]string, error)) error {
+	up.Lock()
+	defer up.Unlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(up.root, usersFile))
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	if s := strings.TrimSuffix(string(data), "\n"); s != "" {
+		lines = strings.Split(s, "\n")
+	}
+
+	lines, err = edit(lines)
+	if err != nil {
+		return err
+	}
+
+	return up.save([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// Add a user who is in no groups, and save the users file.
+func (up *vUsers) AddUser(id int, name string) error {
+	return up.edit(func(lines []string) ([]string, error) {
+		if _, present := up.nameToUser[name]; present {
+			return nil, fmt.Errorf("user '%s' already exists", name)
+		}
+		if _, present := up.idToUser[id]; present {
+			return nil, fmt.Errorf("user id %d already exists", id)
+		}
+		return append(lines, fmt.Sprintf("%d:%s:", id, name)), nil
+	})
+}
+
+// Remove a user and save the users file.  A user that is a group
+// of other users can't be removed, nor can the owner (adm unless
+// set otherwise), who owns files with no owner recorded.  Files the
+// user owns are not changed.
+func (up *vUsers) RemoveUser(name string) error {
+	return up.edit(func(lines []string) ([]string, error) {
+		user, present := up.nameToUser[name]
+		if !present {
+			return nil, fmt.Errorf("no user named '%s'", name)
+		}
+		owner := up.owner
+		if owner == "" {
+			owner = "adm"
+		}
+		if name == owner {
+			return nil, fmt.Errorf("can't remove user %s", name)
+		}
+		for _, m := range user.members {
+			if m.Name() != name {
+				return nil, fmt.Errorf("user '%s' is a group of '%s'", name, m.Name())
+			}
+		}
+
+		kept := make([]string, 0, len(lines))
+		for _, line := range lines {
+			columns := strings.Split(line, ":")
+			if len(line) > 0 && line[0] != '#' && len(columns) == 3 && columns[1] == name {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		return kept, nil
+	})
+}
+
+// Add the named user to a group and save the users file.
+func (up *vUsers) AddMember(group, name string) error {
+	return up.editGroups(name, func(groups []string) ([]string, error) {
+		if _, present := up.nameToUser[group]; !present {
+			return nil, fmt.Errorf("no group named '%s'", group)
+		}
+		for _, g := range groups {
+			if g == group {
+				return nil, fmt.Errorf("user '%s' is already in group '%s'", name, group)
+			}
+		}
+		return append(groups, group), nil
+	})
+}
+
+// Take the named user out of a group and save the users file.
+func (up *vUsers) RemoveMember(group, name string) error {
+	return up.editGroups(name, func(groups []string) ([]string, error) {
+		kept := make([]string, 0, len(groups))
+		for _, g := range groups {
+			if g != group {
+				kept = append(kept, g)
+			}
+		}
+		if len(kept) == len(groups) {
+			return nil, fmt.Errorf("user '%s' is not in group '%s'", name, group)
+		}
+		return kept, nil
+	})
+}
+
+// Apply edit to the groups the named user is in, then save and load
+// the users file.  Edit runs with the lock held.
+func (up *vUsers) editGroups(name string, edit func(groups []string) ([]string, error)) error {
+	return up.edit(func(lines []string) ([]string, error) {
+		if _, present := up.nameToUser[name]; !present {
+			return nil, fmt.Errorf("no user named '%s'", name)
+		}
+		for i, line := range lines {
+			columns := strings.Split(line, ":")
+			if len(line) == 0 || line[0] == '#' || len(columns) != 3 || columns[1] != name {
+				continue
+			}
+			var groups []string
+			if columns[2] != "" {
+				groups = strings.Split(columns[2], ",")
+			}
+			groups, err := edit(groups)
+			if err != nil {
+				return nil, err
+			}
+			columns[2] = strings.Join(groups, ",")
+			lines[i] = strings.Join(columns, ":")
+			return lines, nil
+		}
+		return nil, fmt.Errorf("no user named '%s' in %s", name, usersFile)
+	})
+}
+
+// Re-read the users file.  If it doesn't parse, the users don't
+// change.  Lookups block until the new users are in place.
+func (up *vUsers) Reload() error {
+
+	userfn := filepath.Join(up.root, usersFile)
+
+	data, err := ioutil.ReadFile(userfn)
+	if err != nil {
+		return err
+	}
+
+	up.Lock()
+	defer up.Unlock()
+
+	nameToUser, idToUser, err := parseUsersFile(data, userfn, up.owner)
+	if err != nil {
+		return err
+	}
+
+	up.load(nameToUser, idToUser)
+
+	return nil
+}
+
+// Write a file by writing a temporary file in the same directory
+// and renaming it, so readers see either the old or new contents.
+func writeFileAtomic(fn string, data []byte, perm os.FileMode) error {
+
+	fp, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := fp.Name()
+
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
 	}
 
-	return &vUsers{
-		root:       root,
-		nameToUser: nameToUser,
-		idToUser:   idToUser}, nil
+	return nil
 }
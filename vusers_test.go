@@ -5,12 +5,20 @@
 package vufs
 
 import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
 	"testing"
+
+	"9fans.net/go/plan9"
+	"github.com/lionkov/go9p/p"
 )
 
 func TestUserFileLoaded(t *testing.T) {
 
-	users, _ := NewVusers("./test")
+	users, _ := NewVusers("./test", "")
 
 	if users.Uname2User("adm") == nil {
 		t.Error("Uname2User(\"adm\") was nil")
@@ -56,3 +64,475 @@ func TestUserFileLoaded(t *testing.T) {
 		}
 	}
 }
+
+func TestSetUsers(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	contents := initialFiles["/adm/users"].contents + "5:shemp:moe\n"
+	err := fs.SetUsers([]byte(contents))
+	if err != nil {
+		t.Fatalf("SetUsers: %v\n", err)
+	}
+
+	data, err := ioutil.ReadFile(rootdir + "/" + usersFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if string(data) != contents {
+		t.Errorf("users file = '%s', expected '%s'\n", data, contents)
+	}
+
+	u := fs.Upool.Uname2User("shemp")
+	if u == nil {
+		t.Fatal("shemp not found after SetUsers")
+	}
+	if len(u.Groups()) != 1 || u.Groups()[0].Name() != "moe" {
+		t.Errorf("shemp groups = %v, expected [moe]\n", u.Groups())
+	}
+	if _, err = conn.Attach(nil, "shemp", "/"); err != nil {
+		t.Errorf("attach as shemp: %v\n", err)
+	}
+
+	// Invalid contents leave both the file and the users alone.
+	for _, bad := range []string{
+		"x:bad:\n",
+		"6:larry:\n" + contents,
+		"6:joe:nosuchgroup\n",
+	} {
+		err = fs.SetUsers([]byte(bad))
+		if err == nil {
+			t.Errorf("SetUsers accepted '%s'\n", bad)
+		}
+	}
+	data, err = ioutil.ReadFile(rootdir + "/" + usersFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if string(data) != contents {
+		t.Errorf("users file changed to '%s'\n", data)
+	}
+	if fs.Upool.Uname2User("shemp") == nil {
+		t.Error("shemp lost after invalid SetUsers")
+	}
+}
+
+func TestNoAdm(t *testing.T) {
+
+	fs := newfs(rootdir)
+
+	// adm owns files with no owner recorded, so a users file
+	// without adm is refused at startup ...
+	for _, contents := range []string{"", "2:larry:\n3:moe:moe\n"} {
+		err := ioutil.WriteFile(rootdir+"/"+usersFile, []byte(contents), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile: %v\n", err)
+		}
+		_, err = NewVusers(rootdir, "")
+		if err == nil || !strings.Contains(err.Error(), "No user adm") {
+			t.Errorf("NewVusers with '%s': got %v, expected no user adm\n", contents, err)
+		}
+
+		// ... and when reloaded, leaving the users alone.
+		if err = fs.ReloadUsers(); err == nil {
+			t.Errorf("ReloadUsers accepted '%s'\n", contents)
+		}
+		if err = fs.SetUsers([]byte(contents)); err == nil {
+			t.Errorf("SetUsers accepted '%s'\n", contents)
+		}
+		if fs.Upool.Uname2User("adm") == nil {
+			t.Error("adm lost after an invalid users file\n")
+		}
+	}
+
+	// With another owner, it is that user the file must have.
+	fs.Owner = "moe"
+	if err := fs.SetUsers([]byte("1:adm:\n2:larry:\n")); err == nil {
+		t.Error("SetUsers accepted a users file without the owner\n")
+	}
+	if err := fs.SetUsers([]byte("2:larry:\n3:moe:moe\n")); err != nil {
+		t.Errorf("SetUsers without adm: %v\n", err)
+	}
+	if err := fs.Ping(); err != nil {
+		t.Errorf("Ping without adm: %v\n", err)
+	}
+
+	// Users loaded for that owner start without adm, and the owner
+	// can't be removed.
+	if _, err := NewVusers(rootdir, "shemp"); err == nil {
+		t.Error("NewVusers accepted an owner not in the users file\n")
+	}
+	up, err := NewVusers(rootdir, "moe")
+	if err != nil {
+		t.Fatalf("NewVusers without adm: %v\n", err)
+	}
+	fs = New(rootdir, WithUsers(up), WithDefaultUser("moe"))
+	if err = fs.Ping(); err != nil {
+		t.Errorf("Ping without adm: %v\n", err)
+	}
+	if up.RemoveUser("moe") == nil {
+		t.Error("removed the owner moe\n")
+	}
+	if err = up.RemoveUser("larry"); err != nil {
+		t.Errorf("RemoveUser: %v\n", err)
+	}
+}
+
+func TestReloadUsers(t *testing.T) {
+
+	var fs *VuFs
+	conn := runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+
+	contents := initialFiles["/adm/users"].contents + "5:shemp:moe\n"
+	err := ioutil.WriteFile(rootdir+"/"+usersFile, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	if _, err = conn.Attach(nil, "shemp", "/"); err == nil {
+		t.Error("attached as shemp before reload")
+	}
+
+	// Reload while other requests are in flight.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			_, err := read(conn, "moe", "/moe-moe.txt")
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 10; i++ {
+		err = fs.ReloadUsers()
+		if err != nil {
+			t.Fatalf("ReloadUsers: %v\n", err)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Errorf("read during reload: %v\n", err)
+	}
+
+	if _, err = conn.Attach(nil, "shemp", "/"); err != nil {
+		t.Errorf("attach as shemp: %v\n", err)
+	}
+
+	// A file that doesn't parse leaves the users alone.
+	err = ioutil.WriteFile(rootdir+"/"+usersFile, []byte("x:bad:\n"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v\n", err)
+	}
+	if fs.ReloadUsers() == nil {
+		t.Error("ReloadUsers accepted a bad users file")
+	}
+	if fs.Upool.Uname2User("shemp") == nil {
+		t.Error("shemp lost after invalid reload")
+	}
+}
+
+func TestWriteUsersFile(t *testing.T) {
+
+	conn := runserver(rootdir, port)
+
+	adm, err := conn.Attach(nil, "adm", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	fid, err := adm.Open("/"+usersFile, plan9.OWRITE|plan9.OTRUNC)
+	if err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	contents := initialFiles["/adm/users"].contents + "5:shemp:moe\n"
+	if _, err = fid.Write([]byte(contents)); err != nil {
+		t.Fatalf("write: %v\n", err)
+	}
+	if _, err = conn.Attach(nil, "shemp", "/"); err == nil {
+		t.Error("attached as shemp before clunk\n")
+	}
+	fid.Close()
+	if _, err = conn.Attach(nil, "shemp", "/"); err != nil {
+		t.Errorf("attach as shemp: %v\n", err)
+	}
+
+	// Only its owner can open the file, even if others could read it.
+	err = os.Chmod(rootdir+"/"+usersFile, 0644)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+	moe, err := conn.Attach(nil, "moe", "/")
+	if err != nil {
+		t.Fatalf("attach: %v\n", err)
+	}
+	if fid, err = moe.Open("/"+usersFile, plan9.OREAD); err == nil {
+		fid.Close()
+		t.Error("moe opened the users file\n")
+	}
+	if fid, err = adm.Open("/"+usersFile, plan9.OREAD); err != nil {
+		t.Errorf("adm open: %v\n", err)
+	} else {
+		fid.Close()
+	}
+
+	// Nor can others remove or rename it, or adm, even with write
+	// permission on the directory.
+	for _, dir := range []string{rootdir, rootdir + "/adm"} {
+		if err = os.Chmod(dir, 0777); err != nil {
+			t.Fatalf("chmod: %v\n", err)
+		}
+	}
+	if err = moe.Remove("/" + usersFile); err == nil {
+		t.Error("moe removed the users file\n")
+	}
+	d := new(plan9.Dir)
+	for _, tt := range []struct{ path, name string }{
+		{"/" + usersFile, "users.old"},
+		{"/adm", "adm.old"},
+	} {
+		d.Null()
+		d.Name = tt.name
+		if err = moe.Wstat(tt.path, d); err == nil {
+			t.Errorf("moe renamed %s\n", tt.path)
+		}
+	}
+
+	// Nor change it with a wstat, or rename another file onto it.
+	d.Null()
+	d.Length = 0
+	if err = moe.Wstat("/"+usersFile, d); err == nil {
+		t.Error("moe truncated the users file\n")
+	}
+	d.Null()
+	d.Mode = 0666
+	if err = moe.Wstat("/"+usersFile, d); err == nil {
+		t.Error("moe changed the mode of the users file\n")
+	}
+	for _, name := range []string{"/adm/x", "/adm/y"} {
+		fid, err = moe.Create(name, plan9.OWRITE, 0644)
+		if err != nil {
+			t.Fatalf("create %s: %v\n", name, err)
+		}
+		fid.Close()
+	}
+	d.Null()
+	d.Name = "users"
+	if err = moe.Wstat("/adm/x", d); err == nil {
+		t.Error("moe renamed a file onto the users file\n")
+	}
+	data, err := ioutil.ReadFile(rootdir + "/" + usersFile)
+	if err != nil || string(data) != contents {
+		t.Errorf("users file is '%s', %v, expected '%s'\n", data, err, contents)
+	}
+
+	// Even its owner can't rename a file onto it, or any other.
+	if err = adm.Wstat("/adm/x", d); err == nil {
+		t.Error("adm renamed a file onto the users file\n")
+	}
+	d.Name = "y"
+	if err = moe.Wstat("/adm/x", d); err == nil {
+		t.Error("moe renamed a file onto another\n")
+	}
+
+	// A wstat that truncates it reloads the users.
+	d.Null()
+	d.Length = uint64(len(initialFiles["/adm/users"].contents))
+	if err = adm.Wstat("/"+usersFile, d); err != nil {
+		t.Errorf("adm truncate: %v\n", err)
+	}
+	if _, err = conn.Attach(nil, "shemp", "/"); err == nil {
+		t.Error("attached as shemp after truncating the users file\n")
+	}
+}
+
+func TestTruncUsersFile(t *testing.T) {
+
+	fs := newfs(rootdir)
+	var buf strings.Builder
+	fs.Logger = log.New(&buf, "", 0)
+
+	// Truncating the file changes it, so clunking reloads it, even
+	// without a write.  Empty, it has no adm, so the users stay.
+	s := fs.Connect("adm")
+	fid, err := s.Walk("/" + usersFile)
+	if err != nil {
+		t.Fatalf("walk: %v\n", err)
+	}
+	if _, err = s.Open(fid, p.OWRITE|p.OTRUNC); err != nil {
+		t.Fatalf("open: %v\n", err)
+	}
+	s.Clunk(fid)
+	if !strings.Contains(buf.String(), "reload") {
+		t.Errorf("no reload after truncating the users file; log '%s'\n", buf.String())
+	}
+	if fs.Upool.Uname2User("moe") == nil {
+		t.Error("moe lost after truncating the users file\n")
+	}
+
+	// Only its owner may move the users file away.
+	err = os.Chmod(rootdir+"/adm", 0777)
+	if err != nil {
+		t.Fatalf("chmod: %v\n", err)
+	}
+	if err = fs.Move("moe", "/"+usersFile, "/adm/users.old"); err != ErrPerm {
+		t.Errorf("moe move: got %v, expected %v\n", err, ErrPerm)
+	}
+}
+
+func TestAddRemoveUser(t *testing.T) {
+
+	var fs *VuFs
+	runserverWith(rootdir, port, func(v *VuFs) { fs = v })
+	up := fs.Upool.(*vUsers)
+
+	err := up.AddUser(5, "shemp")
+	if err != nil {
+		t.Fatalf("AddUser: %v\n", err)
+	}
+	if u := up.Uname2User("shemp"); u == nil || u.Id() != 5 {
+		t.Errorf("Uname2User(\"shemp\") = %v\n", u)
+	}
+
+	// The user is saved to the users file.
+	data, err := ioutil.ReadFile(rootdir + "/" + usersFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if expected := initialFiles["/adm/users"].contents + "5:shemp:\n"; string(data) != expected {
+		t.Errorf("users file = '%s', expected '%s'\n", data, expected)
+	}
+	reread, err := NewVusers(rootdir, "")
+	if err != nil {
+		t.Fatalf("NewVusers: %v\n", err)
+	}
+	if reread.Uname2User("shemp") == nil {
+		t.Error("shemp not in re-read users file")
+	}
+
+	// Names and ids must be new.
+	if up.AddUser(6, "shemp") == nil {
+		t.Error("added shemp twice")
+	}
+	if up.AddUser(5, "joe") == nil {
+		t.Error("added a second user with id 5")
+	}
+	if up.AddUser(6, "jo:e") == nil {
+		t.Error("added user jo:e")
+	}
+
+	err = up.RemoveUser("shemp")
+	if err != nil {
+		t.Fatalf("RemoveUser: %v\n", err)
+	}
+	if up.Uname2User("shemp") != nil {
+		t.Error("shemp still found after RemoveUser")
+	}
+	data, err = ioutil.ReadFile(rootdir + "/" + usersFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if string(data) != initialFiles["/adm/users"].contents {
+		t.Errorf("users file = '%s', expected '%s'\n", data, initialFiles["/adm/users"].contents)
+	}
+
+	// Groups of other users, adm, and unknown users can't be removed.
+	err = fs.SetUsers([]byte(initialFiles["/adm/users"].contents + "5:shemp:moe\n"))
+	if err != nil {
+		t.Fatalf("SetUsers: %v\n", err)
+	}
+	for _, name := range []string{"moe", "adm", "joe"} {
+		if up.RemoveUser(name) == nil {
+			t.Errorf("removed %s\n", name)
+		}
+	}
+}
+
+func TestAddRemoveMember(t *testing.T) {
+
+	fs := newfs(rootdir)
+	up := fs.Upool.(*vUsers)
+
+	// As a fid would, hold on to moe across the changes.
+	moe := up.Uname2User("moe")
+	f := &p.Dir{Uid: "adm", Gid: "adm", Mode: 0070}
+	if CheckPerm(f, moe, p.DMREAD) {
+		t.Fatal("moe can read a file only group adm can\n")
+	}
+
+	err := up.AddMember("adm", "moe")
+	if err != nil {
+		t.Fatalf("AddMember: %v\n", err)
+	}
+	if !CheckPerm(f, moe, p.DMREAD) {
+		t.Error("moe cannot read after joining group adm\n")
+	}
+	data, err := ioutil.ReadFile(rootdir + "/" + usersFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v\n", err)
+	}
+	if !strings.Contains(string(data), "\n3:moe:moe,adm\n") {
+		t.Errorf("users file = '%s', expected moe in group adm\n", data)
+	}
+
+	err = up.RemoveMember("adm", "moe")
+	if err != nil {
+		t.Fatalf("RemoveMember: %v\n", err)
+	}
+	if CheckPerm(f, moe, p.DMREAD) {
+		t.Error("moe can still read after leaving group adm\n")
+	}
+
+	for _, tt := range []struct {
+		add         bool
+		group, name string
+	}{
+		{true, "moe", "moe"},
+		{true, "adm", "joe"},
+		{true, "joe", "moe"},
+		{false, "adm", "moe"},
+	} {
+		if tt.add && up.AddMember(tt.group, tt.name) == nil {
+			t.Errorf("added %s to %s\n", tt.name, tt.group)
+		}
+		if !tt.add && up.RemoveMember(tt.group, tt.name) == nil {
+			t.Errorf("removed %s from %s\n", tt.name, tt.group)
+		}
+	}
+}
+
+func TestIsMember(t *testing.T) {
+
+	const ngroups = 1000
+	var lines []string
+	var names []string
+	for i := 1; i <= ngroups; i++ {
+		name := fmt.Sprintf("g%d", i)
+		lines = append(lines, fmt.Sprintf("%d:%s:", i, name))
+		names = append(names, name)
+	}
+	lines = append(lines, fmt.Sprintf("%d:joe:%s", ngroups+1, strings.Join(names, ",")))
+	lines = append(lines, fmt.Sprintf("%d:sam:", ngroups+2))
+
+	nameToUser, idToUser, err := parseUsers([]byte(strings.Join(lines, "\n")+"\n"), "test")
+	if err != nil {
+		t.Fatalf("parseUsers: %v\n", err)
+	}
+	up := new(vUsers)
+	up.load(nameToUser, idToUser)
+
+	joe := up.Uname2User("joe")
+	if joe.IsMember(nil) {
+		t.Error("joe is a member of a nil group\n")
+	}
+	for _, name := range []string{"g1", "g500", "g1000"} {
+		if !joe.IsMember(up.Gname2Group(name)) {
+			t.Errorf("joe is not a member of %s\n", name)
+		}
+	}
+	if joe.IsMember(up.Gname2Group("sam")) {
+		t.Error("joe is a member of sam\n")
+	}
+	if g := up.Gname2Group("nosuchgroup"); g != nil {
+		t.Errorf("Gname2Group(\"nosuchgroup\") = %v, expected nil\n", g)
+	}
+}